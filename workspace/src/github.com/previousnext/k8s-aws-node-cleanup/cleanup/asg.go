@@ -0,0 +1,85 @@
+package cleanup
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// The maximum number of instance IDs AWS accepts in a single
+// DescribeAutoScalingInstances call.
+const describeASGBatchSize = 50
+
+// AutoscalingAPI is the subset of the Auto Scaling API we use, so it can be
+// faked in tests.
+type AutoscalingAPI interface {
+	DescribeAutoScalingInstancesWithContext(aws.Context, *autoscaling.DescribeAutoScalingInstancesInput, ...request.Option) (*autoscaling.DescribeAutoScalingInstancesOutput, error)
+}
+
+// What Auto Scaling knows about an instance in one of its groups.
+type asgInstance struct {
+	lifecycleState       string
+	protectedFromScaleIn bool
+}
+
+// Helper function to look up a set of instances in Auto Scaling, keyed by
+// instance ID. Instances which aren't part of an Auto Scaling group are left
+// out. Each call to AWS is given the timeout to complete.
+func asgInstances(ctx context.Context, svc AutoscalingAPI, ids []string, timeout time.Duration) (map[string]asgInstance, error) {
+	instances := make(map[string]asgInstance)
+
+	for start := 0; start < len(ids); start += describeASGBatchSize {
+		end := start + describeASGBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		err := describeASGInstances(ctx, svc, ids[start:end], instances, timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return instances, nil
+}
+
+// Helper function to describe a single batch of instances, following any
+// further pages of results.
+func describeASGInstances(ctx context.Context, svc AutoscalingAPI, ids []string, instances map[string]asgInstance, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input := &autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	}
+
+	for {
+		resp, err := svc.DescribeAutoScalingInstancesWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		for _, instance := range resp.AutoScalingInstances {
+			instances[aws.StringValue(instance.InstanceId)] = asgInstance{
+				lifecycleState:       aws.StringValue(instance.LifecycleState),
+				protectedFromScaleIn: aws.BoolValue(instance.ProtectedFromScaleIn),
+			}
+		}
+
+		if aws.StringValue(resp.NextToken) == "" {
+			return nil
+		}
+
+		input.NextToken = resp.NextToken
+	}
+}
+
+// Helper function to check if an Auto Scaling lifecycle state means the
+// instance is on its way out, eg. Terminating:Wait while a lifecycle hook runs.
+func isTerminating(state string) bool {
+	return strings.HasPrefix(state, autoscaling.LifecycleStateTerminating)
+}
@@ -0,0 +1,92 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fake Auto Scaling client which knows the lifecycle state of a fixed set of
+// instances, and returns a single instance per page.
+type fakeAutoscaling struct {
+	states    map[string]string
+	protected map[string]bool
+	calls     int
+}
+
+func (f *fakeAutoscaling) DescribeAutoScalingInstancesWithContext(ctx aws.Context, input *autoscaling.DescribeAutoScalingInstancesInput, opts ...request.Option) (*autoscaling.DescribeAutoScalingInstancesOutput, error) {
+	f.calls++
+
+	var ids []string
+
+	for _, id := range input.InstanceIds {
+		if _, ok := f.states[*id]; ok {
+			ids = append(ids, *id)
+		}
+	}
+
+	page := 0
+	if input.NextToken != nil {
+		fmt.Sscanf(*input.NextToken, "%d", &page)
+	}
+
+	resp := &autoscaling.DescribeAutoScalingInstancesOutput{}
+
+	if page >= len(ids) {
+		return resp, nil
+	}
+
+	resp.AutoScalingInstances = []*autoscaling.InstanceDetails{
+		{
+			InstanceId:           aws.String(ids[page]),
+			LifecycleState:       aws.String(f.states[ids[page]]),
+			ProtectedFromScaleIn: aws.Bool(f.protected[ids[page]]),
+		},
+	}
+
+	if page+1 < len(ids) {
+		resp.NextToken = aws.String(fmt.Sprint(page + 1))
+	}
+
+	return resp, nil
+}
+
+func TestASGInstances(t *testing.T) {
+	svc := &fakeAutoscaling{
+		states: map[string]string{
+			"i-inservice":   autoscaling.LifecycleStateInService,
+			"i-terminating": autoscaling.LifecycleStateTerminatingWait,
+		},
+		protected: map[string]bool{"i-inservice": true},
+	}
+
+	ids := []string{"i-inservice", "i-terminating", "i-standalone"}
+
+	for i := 0; i < 60; i++ {
+		ids = append(ids, fmt.Sprintf("i-%d", i))
+	}
+
+	instances, err := asgInstances(context.Background(), svc, ids, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]asgInstance{
+		"i-inservice":   {lifecycleState: autoscaling.LifecycleStateInService, protectedFromScaleIn: true},
+		"i-terminating": {lifecycleState: autoscaling.LifecycleStateTerminatingWait},
+	}, instances)
+
+	// Two pages for the first batch, one for the second.
+	assert.Equal(t, 3, svc.calls)
+}
+
+func TestIsTerminating(t *testing.T) {
+	assert.True(t, isTerminating(autoscaling.LifecycleStateTerminating))
+	assert.True(t, isTerminating(autoscaling.LifecycleStateTerminatingWait))
+	assert.True(t, isTerminating(autoscaling.LifecycleStateTerminatingProceed))
+	assert.False(t, isTerminating(autoscaling.LifecycleStateInService))
+	assert.False(t, isTerminating(""))
+}
@@ -0,0 +1,159 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// What came of a deletion decision, as recorded in the audit log.
+const (
+	auditDeleted  = "deleted"
+	auditFailed   = "failed"
+	auditCordoned = "cordoned"
+	auditDryRun   = "dry-run"
+)
+
+// Appends a JSON line per deletion decision to a file, independent of the
+// logs, rotating it to a single backup once it reaches a maximum size.
+type auditLog struct {
+	sync.Mutex
+
+	path    string
+	maxSize int64
+
+	file *os.File
+	size int64
+}
+
+// A single deletion decision, as written to the audit log.
+type auditEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Node       string    `json:"node"`
+	InstanceID string    `json:"instance_id"`
+	State      string    `json:"state"`
+	Reason     string    `json:"reason"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+	DryRun     bool      `json:"dry_run"`
+}
+
+// Helper function to record deletion decisions, when an audit log has been
+// configured.
+func newAuditLog(n Notifications) *auditLog {
+	return &auditLog{
+		path:    n.AuditLog,
+		maxSize: n.AuditLogMaxSize,
+	}
+}
+
+// Decided records what came of deciding to delete a node: whether it was
+// deleted, failed to be (with the error), was cordoned for review instead, or
+// would have been in dry-run mode. The line is written before returning, so it
+// survives a crash.
+func (a *auditLog) Decided(node, instanceID, state, reason, outcome string, cause error, now time.Time) {
+	if a.path == "" {
+		return
+	}
+
+	entry := auditEntry{
+		Timestamp:  now.UTC(),
+		Node:       node,
+		InstanceID: instanceID,
+		State:      state,
+		Reason:     reason,
+		Outcome:    outcome,
+		DryRun:     outcome == auditDryRun,
+	}
+
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+
+	err := a.write(entry)
+	if err != nil {
+		slog.Error("Failed to write to audit log", "path", a.path, "node", node, "instance_id", instanceID, "error", err)
+	}
+}
+
+// Close closes the audit log, if it was ever opened.
+func (a *auditLog) Close() {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func (a *auditLog) write(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.file == nil {
+		err = a.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		err = a.rotate()
+		if err != nil {
+			return err
+		}
+
+		err = a.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+
+	return err
+}
+
+// Helper function to open the audit log for appending, picking up where the
+// last run left off.
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+
+	return nil
+}
+
+// Helper function to move the audit log aside, replacing the last backup, so
+// the next write starts a new file.
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	a.file = nil
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(a.path, a.path+".1")
+}
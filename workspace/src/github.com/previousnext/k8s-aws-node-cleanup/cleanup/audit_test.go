@@ -0,0 +1,89 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to read the entries written to an audit log file.
+func readAudit(t *testing.T, path string) []auditEntry {
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	var entries []auditEntry
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry auditEntry
+
+		err := json.Unmarshal([]byte(line), &entry)
+		assert.Nil(t, err)
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	a := &auditLog{path: path}
+	defer a.Close()
+
+	a.Decided("node1", "i-1", ec2.InstanceStateNameTerminated, "node is not ready and its instance is terminated", auditDeleted, nil, now)
+	a.Decided("node2", "i-2", stateNotFound, "node is not ready and its instance is not-found", auditDryRun, nil, now)
+	a.Decided("node3", "i-3", ec2.InstanceStateNameTerminated, "node is not ready and its instance is terminated", auditFailed, errors.New("finalizer is stuck"), now)
+	a.Decided("node4", "i-4", ec2.InstanceStateNameTerminated, "node is not ready and its instance is terminated", auditCordoned, nil, now)
+
+	assert.Equal(t, []auditEntry{
+		{Timestamp: now, Node: "node1", InstanceID: "i-1", State: ec2.InstanceStateNameTerminated, Reason: "node is not ready and its instance is terminated", Outcome: auditDeleted},
+		{Timestamp: now, Node: "node2", InstanceID: "i-2", State: stateNotFound, Reason: "node is not ready and its instance is not-found", Outcome: auditDryRun, DryRun: true},
+		{Timestamp: now, Node: "node3", InstanceID: "i-3", State: ec2.InstanceStateNameTerminated, Reason: "node is not ready and its instance is terminated", Outcome: auditFailed, Error: "finalizer is stuck"},
+		{Timestamp: now, Node: "node4", InstanceID: "i-4", State: ec2.InstanceStateNameTerminated, Reason: "node is not ready and its instance is terminated", Outcome: auditCordoned},
+	}, readAudit(t, path))
+
+	// Restarting appends to the existing file.
+	a.Close()
+	a.Decided("node5", "i-5", ec2.InstanceStateNameTerminated, "", auditDeleted, nil, now)
+	assert.Len(t, readAudit(t, path), 5)
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	// Room for a couple of entries per file.
+	a := &auditLog{path: path, maxSize: 300}
+	defer a.Close()
+
+	for _, node := range []string{"node1", "node2", "node3", "node4", "node5"} {
+		a.Decided(node, "i-1", ec2.InstanceStateNameTerminated, "", auditDeleted, nil, now)
+	}
+
+	current := readAudit(t, path)
+	backup := readAudit(t, path+".1")
+
+	assert.Equal(t, "node5", current[len(current)-1].Node)
+	assert.Equal(t, "node4", backup[len(backup)-1].Node)
+	assert.True(t, len(current)+len(backup) < 5)
+
+	info, err := os.Stat(path + ".1")
+	assert.Nil(t, err)
+	assert.True(t, info.Size() <= 300, info.Size())
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	a := &auditLog{}
+	a.Decided("node1", "i-1", ec2.InstanceStateNameTerminated, "", auditDeleted, nil, time.Now())
+	a.Close()
+	assert.Nil(t, a.file)
+}
@@ -0,0 +1,50 @@
+// Package cleanup deletes Kubernetes nodes whose backing EC2 instances have
+// gone away. A Reconciler can run passes on its own schedule with Run, or be
+// driven by the caller with Reconcile.
+package cleanup
+
+const (
+	// The maximum number of instance IDs AWS accepts in a single DescribeInstances call.
+	describeBatchSize = 100
+
+	// Component is the name we record Kubernetes events as, and report
+	// traces and pushed metrics under.
+	Component = "k8s-aws-node-cleanup"
+
+	// The reason recorded on events for nodes which have been deleted.
+	eventReasonNodeCleanup = "NodeCleanup"
+
+	// LabelCandidate is set on the nodes cordoned instead of deleted, with
+	// Options.CordonOnly.
+	LabelCandidate = "k8s-aws-cleanup/candidate"
+
+	// Role labels which mark control plane nodes, these are never deleted.
+	labelRoleMaster       = "node-role.kubernetes.io/master"
+	labelRoleControlPlane = "node-role.kubernetes.io/control-plane"
+
+	// Annotations written to a node just before it is deleted, so the API
+	// server's audit log records why it was removed.
+	annotationReason    = "k8s-aws-cleanup/reason"
+	annotationDeletedAt = "k8s-aws-cleanup/deleted-at"
+
+	// AnnotationPendingDelete records when a node first qualified for
+	// deletion, with Options.AnnotateThenWait.
+	AnnotationPendingDelete = "k8s-aws-cleanup/pending-delete"
+
+	// The state we report for instances which AWS no longer knows about.
+	stateNotFound = "not-found"
+
+	// The state we report for nodes we can't find an instance ID for.
+	stateUnknown = "unknown"
+
+	// The state we report for nodes when instances aren't being looked up.
+	stateUnchecked = "unchecked"
+
+	// The tag which marks the instances belonging to a cluster, suffixed
+	// with the cluster name.
+	clusterTagPrefix = "kubernetes.io/cluster/"
+	clusterTagOwned  = "owned"
+
+	// The error code AWS returns when describing an instance which has been deregistered.
+	errCodeInstanceNotFound = "InvalidInstanceID.NotFound"
+)
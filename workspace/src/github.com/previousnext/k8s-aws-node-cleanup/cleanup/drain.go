@@ -0,0 +1,220 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	policy "k8s.io/client-go/pkg/apis/policy/v1beta1"
+)
+
+const (
+	// How long to wait before retrying evictions blocked by a PodDisruptionBudget.
+	drainRetryInterval = 5 * time.Second
+
+	// Annotation the kubelet sets on the API representation of a static pod.
+	annotationMirrorPod = "kubernetes.io/config.mirror"
+)
+
+// Returned when pods are still being protected by a PodDisruptionBudget after
+// the drain timeout has passed.
+var errDrainTimeout = errors.New("timed out waiting for pods to be evicted")
+
+// Returned when a drain is cancelled part way through, for example because we
+// are shutting down, saying how far it got.
+type interruptedDrainError struct {
+	cordoned bool
+	pending  int
+	err      error
+}
+
+func (e *interruptedDrainError) Error() string {
+	return fmt.Sprintf("drain interrupted with %d pods left to evict: %v", e.pending, e.err)
+}
+
+func (e *interruptedDrainError) Unwrap() error {
+	return e.err
+}
+
+// Helper function to cordon a node and evict its pods using the eviction API,
+// so PodDisruptionBudgets are respected. The drain gives up as soon as the
+// context is cancelled.
+func drain(ctx context.Context, clientset kubernetes.Interface, node v1.Node, timeout time.Duration) error {
+	if ctx.Err() != nil {
+		return &interruptedDrainError{cordoned: node.Spec.Unschedulable, err: ctx.Err()}
+	}
+
+	if !node.Spec.Unschedulable {
+		node.Spec.Unschedulable = true
+
+		err := cordonNode(clientset, node.ObjectMeta.Name)
+		if err != nil {
+			return fmt.Errorf("failed to cordon node: %v", err)
+		}
+	}
+
+	pods, err := podsOnNode(clientset, node.ObjectMeta.Name)
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	var pending []v1.Pod
+
+	for _, pod := range pods {
+		if isEvictable(pod) {
+			pending = append(pending, pod)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var blocked []v1.Pod
+
+		for i, pod := range pending {
+			if ctx.Err() != nil {
+				return &interruptedDrainError{cordoned: true, pending: len(blocked) + len(pending) - i, err: ctx.Err()}
+			}
+
+			err := clientset.CoreV1().Pods(pod.ObjectMeta.Namespace).Evict(&policy.Eviction{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      pod.ObjectMeta.Name,
+					Namespace: pod.ObjectMeta.Namespace,
+				},
+			})
+
+			// The pod might have been removed since we listed it.
+			if err == nil || kerrors.IsNotFound(err) {
+				continue
+			}
+
+			// A PodDisruptionBudget is blocking this eviction, try again shortly.
+			if kerrors.IsTooManyRequests(err) {
+				blocked = append(blocked, pod)
+				continue
+			}
+
+			return fmt.Errorf("failed to evict pod %s/%s: %v", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, err)
+		}
+
+		if len(blocked) == 0 {
+			return nil
+		}
+
+		if time.Now().Add(drainRetryInterval).After(deadline) {
+			return errDrainTimeout
+		}
+
+		pending = blocked
+
+		select {
+		case <-ctx.Done():
+			return &interruptedDrainError{cordoned: true, pending: len(pending), err: ctx.Err()}
+		case <-time.After(drainRetryInterval):
+		}
+	}
+}
+
+// Helper function to list the pods scheduled to a node.
+func podsOnNode(clientset kubernetes.Interface, name string) ([]v1.Pod, error) {
+	list, err := clientset.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", name).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Not every client honours field selectors (the fake clientset doesn't),
+	// and counting another node's pods would keep this one around.
+	var pods []v1.Pod
+
+	for _, pod := range list.Items {
+		if pod.Spec.NodeName == name {
+			pods = append(pods, pod)
+		}
+	}
+
+	return pods, nil
+}
+
+// What a pod scheduled to a node says about whether the node is in use.
+type podKind string
+
+const (
+	// A pod which would have to go somewhere else if the node went away.
+	podWorkload podKind = "workload"
+
+	// Pods which live and die with the node.
+	podMirror    podKind = "mirror"
+	podDaemonSet podKind = "daemonset"
+
+	// Pods which are done, or on their way out. Pods on a dead node are
+	// stuck terminating until the node is deleted.
+	podFinished    podKind = "finished"
+	podTerminating podKind = "terminating"
+)
+
+// Helper function to classify a pod scheduled to a node. Only workloads count
+// towards the node being in use.
+func classifyPod(pod v1.Pod) podKind {
+	switch {
+	case isMirror(pod):
+		return podMirror
+	case isDaemonSet(pod):
+		return podDaemonSet
+	case pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed:
+		return podFinished
+	case pod.ObjectMeta.DeletionTimestamp != nil:
+		return podTerminating
+	}
+
+	return podWorkload
+}
+
+// Helper function to find the workloads still scheduled to a node.
+func workloadPods(clientset kubernetes.Interface, name string) ([]v1.Pod, error) {
+	pods, err := podsOnNode(clientset, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads []v1.Pod
+
+	for _, pod := range pods {
+		if classifyPod(pod) == podWorkload {
+			workloads = append(workloads, pod)
+		}
+	}
+
+	return workloads, nil
+}
+
+// Helper function to check if a pod should be evicted when draining. Mirror
+// pods can't be evicted and DaemonSet pods would just be rescheduled.
+func isEvictable(pod v1.Pod) bool {
+	return !isMirror(pod) && !isDaemonSet(pod)
+}
+
+// Helper function to check if a pod is the API representation of a static pod
+// run by the kubelet.
+func isMirror(pod v1.Pod) bool {
+	_, ok := pod.ObjectMeta.Annotations[annotationMirrorPod]
+	return ok
+}
+
+// Helper function to check if a pod belongs to a DaemonSet.
+func isDaemonSet(pod v1.Pod) bool {
+	for _, owner := range pod.ObjectMeta.OwnerReferences {
+		if owner.Kind == "DaemonSet" {
+			return true
+		}
+	}
+
+	return false
+}
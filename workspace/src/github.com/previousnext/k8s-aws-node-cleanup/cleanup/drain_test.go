@@ -0,0 +1,250 @@
+package cleanup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	policy "k8s.io/client-go/pkg/apis/policy/v1beta1"
+	core "k8s.io/client-go/testing"
+)
+
+func TestDrain(t *testing.T) {
+	node := v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+	}
+
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+
+	clientset := fake.NewSimpleClientset(&node, &pod)
+
+	// The fake clientset can't apply patches, so record them instead.
+	var patches []string
+
+	clientset.PrependReactor("patch", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		patches = append(patches, string(action.(core.PatchActionImpl).GetPatch()))
+		return true, &v1.Node{}, nil
+	})
+
+	// Nor store evictions.
+	var evicted []string
+
+	clientset.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+
+		eviction := action.(core.CreateAction).GetObject().(*policy.Eviction)
+		evicted = append(evicted, eviction.ObjectMeta.Namespace+"/"+eviction.ObjectMeta.Name)
+
+		return true, nil, nil
+	})
+
+	err := drain(context.Background(), clientset, node, time.Minute)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{`{"spec":{"unschedulable":true}}`}, patches)
+	assert.Equal(t, []string{"default/pod1"}, evicted)
+
+	// Nodes which are already cordoned are left as they are.
+	patches = nil
+	node.Spec.Unschedulable = true
+
+	err = drain(context.Background(), clientset, node, time.Minute)
+	assert.Nil(t, err)
+	assert.Empty(t, patches)
+}
+
+func TestDrainInterrupted(t *testing.T) {
+	node := v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+	}
+
+	pod := v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node1"},
+	}
+
+	clientset := fake.NewSimpleClientset(&node, &pod)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A PodDisruptionBudget blocks the eviction until we shut down.
+	clientset.PrependReactor("create", "pods", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+
+		cancel()
+
+		return true, nil, kerrors.NewGenericServerResponse(kerrors.StatusTooManyRequests, "create", schema.GroupResource{Resource: "pods"}, "pod1", "", 0, false)
+	})
+
+	start := time.Now()
+
+	err := drain(ctx, clientset, node, time.Minute)
+	assert.True(t, time.Since(start) < drainRetryInterval, time.Since(start))
+
+	interrupted, ok := err.(*interruptedDrainError)
+	assert.True(t, ok, err)
+	assert.True(t, interrupted.cordoned)
+	assert.Equal(t, 1, interrupted.pending)
+	assert.Equal(t, context.Canceled, interrupted.err)
+
+	// Nothing happens at all if we are already shutting down.
+	err = drain(ctx, clientset, v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}, time.Minute)
+
+	interrupted, ok = err.(*interruptedDrainError)
+	assert.True(t, ok, err)
+	assert.False(t, interrupted.cordoned)
+}
+
+func TestWorkloadPods(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: "node1"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: "node1"},
+			Status:     v1.PodStatus{Phase: v1.PodSucceeded},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "fluentd",
+				Namespace:       "kube-system",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd"}},
+			},
+			Spec:   v1.PodSpec{NodeName: "node1"},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "kube-proxy",
+				Namespace:   "kube-system",
+				Annotations: map[string]string{annotationMirrorPod: "abc"},
+			},
+			Spec:   v1.PodSpec{NodeName: "node1"},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "other-node", Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: "node2"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		},
+	)
+
+	pods, err := workloadPods(clientset, "node1")
+	assert.Nil(t, err)
+
+	var names []string
+
+	for _, pod := range pods {
+		names = append(names, pod.ObjectMeta.Name)
+	}
+
+	assert.Equal(t, []string{"app"}, names)
+}
+
+func TestClassifyPod(t *testing.T) {
+	deleted := metav1.Now()
+
+	tests := []struct {
+		name string
+		pod  v1.Pod
+		kind podKind
+	}{
+		{
+			name: "bare pod",
+			pod:  v1.Pod{Status: v1.PodStatus{Phase: v1.PodRunning}},
+			kind: podWorkload,
+		},
+		{
+			name: "pending pod",
+			pod:  v1.Pod{Status: v1.PodStatus{Phase: v1.PodPending}},
+			kind: podWorkload,
+		},
+		{
+			name: "replica set pod",
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app"}}},
+				Status:     v1.PodStatus{Phase: v1.PodRunning},
+			},
+			kind: podWorkload,
+		},
+		{
+			name: "daemonset pod",
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd"}}},
+				Status:     v1.PodStatus{Phase: v1.PodRunning},
+			},
+			kind: podDaemonSet,
+		},
+		{
+			name: "mirror pod",
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationMirrorPod: "abc"}},
+				Status:     v1.PodStatus{Phase: v1.PodRunning},
+			},
+			kind: podMirror,
+		},
+		{
+			name: "succeeded pod",
+			pod:  v1.Pod{Status: v1.PodStatus{Phase: v1.PodSucceeded}},
+			kind: podFinished,
+		},
+		{
+			name: "failed pod",
+			pod:  v1.Pod{Status: v1.PodStatus{Phase: v1.PodFailed}},
+			kind: podFinished,
+		},
+		{
+			name: "terminating pod",
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &deleted},
+				Status:     v1.PodStatus{Phase: v1.PodRunning},
+			},
+			kind: podTerminating,
+		},
+		{
+			name: "finished daemonset pod",
+			pod: v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd"}}},
+				Status:     v1.PodStatus{Phase: v1.PodFailed},
+			},
+			kind: podDaemonSet,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.kind, classifyPod(test.pod), test.name)
+	}
+}
+
+func TestIsEvictable(t *testing.T) {
+	assert.True(t, isEvictable(v1.Pod{}))
+
+	assert.False(t, isEvictable(v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{annotationMirrorPod: "abc"},
+		},
+	}))
+
+	assert.False(t, isEvictable(v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd"}},
+		},
+	}))
+}
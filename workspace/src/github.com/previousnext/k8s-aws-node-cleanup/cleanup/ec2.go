@@ -0,0 +1,397 @@
+package cleanup
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// EC2API is the subset of the EC2 API which we depend on, so it can be faked
+// in tests.
+type EC2API interface {
+	DescribeInstancesWithContext(aws.Context, *ec2.DescribeInstancesInput, ...request.Option) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceStatusWithContext(aws.Context, *ec2.DescribeInstanceStatusInput, ...request.Option) (*ec2.DescribeInstanceStatusOutput, error)
+	DescribeInstanceAttributeWithContext(aws.Context, *ec2.DescribeInstanceAttributeInput, ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error)
+	TerminateInstancesWithContext(aws.Context, *ec2.TerminateInstancesInput, ...request.Option) (*ec2.TerminateInstancesOutput, error)
+}
+
+// Helper function to look up the state of an instance, as reported by AWS or
+// stateNotFound when AWS no longer knows about it.
+func instanceState(states map[string]string, id string) string {
+	if state, ok := states[id]; ok {
+		return state
+	}
+
+	return stateNotFound
+}
+
+// Helper function to count how many nodes are backed by an instance in each
+// state. Nodes whose instance can't be looked up are counted as unknown.
+func countStates(nodes []v1.Node, states map[string]string, clients map[string]RegionClient) map[string]int {
+	counts := make(map[string]int)
+
+	for _, node := range nodes {
+		id, err := instanceID(node)
+		if err != nil {
+			counts[stateUnknown]++
+			continue
+		}
+
+		if _, err := nodeRegion(node, clients); err != nil {
+			counts[stateUnknown]++
+			continue
+		}
+
+		counts[instanceState(states, id)]++
+	}
+
+	return counts
+}
+
+// Helper function to check if a ready node's instance is in a state it can't
+// really be ready in. Instances which are starting up may already have a
+// ready kubelet, and without a lookup we know nothing either way.
+func isMismatched(state string) bool {
+	switch state {
+	case ec2.InstanceStateNameRunning, ec2.InstanceStateNamePending, stateUnknown, stateUnchecked:
+		return false
+	}
+
+	return true
+}
+
+// Helper function to check if an instance is on its way to another state.
+func isTransitional(state string) bool {
+	switch state {
+	case ec2.InstanceStateNamePending, ec2.InstanceStateNameStopping, ec2.InstanceStateNameShuttingDown:
+		return true
+	}
+
+	return false
+}
+
+// Helper function to check if an instance state allows its node to be
+// deleted. Instances which no longer exist are always deletable.
+func isDeletable(state string, deletable []string) bool {
+	if state == stateNotFound {
+		return true
+	}
+
+	for _, s := range deletable {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Helper function to remove duplicate instance IDs, keeping the first of each.
+func uniqueIDs(ids []string) []string {
+	var (
+		unique []string
+		seen   = make(map[string]bool)
+	)
+
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+
+		seen[id] = true
+		unique = append(unique, id)
+	}
+
+	return unique
+}
+
+// Describes a batch of AWS instances, recording the state of each.
+type describeFunc func(ctx context.Context, svc EC2API, ids []string, states map[string]string, timeout time.Duration) error
+
+// Helper function to look up the state of a set of AWS instances, keyed by
+// instance ID, describing them in batches. Instances which AWS no longer knows
+// about are left out. Each call to AWS is given the timeout to complete.
+func instanceStates(ctx context.Context, svc EC2API, ids []string, timeout time.Duration, concurrency int, describe describeFunc) (map[string]string, error) {
+	var (
+		states   = make(map[string]string)
+		batches  [][]string
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	// Keep each instance in a single batch, so batches can't disagree.
+	ids = uniqueIDs(ids)
+
+	for start := 0; start < len(ids); start += describeBatchSize {
+		end := start + describeBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batches = append(batches, ids[start:end])
+	}
+
+	parallel(len(batches), concurrency, func(i int) {
+		batch := make(map[string]string)
+
+		err := describe(ctx, svc, batches[i], batch, timeout)
+		if isNotFound(err) {
+			// AWS fails the whole call if any instance in the batch is gone, so
+			// describe them one at a time to find out which ones are left.
+			for _, id := range batches[i] {
+				err = describe(ctx, svc, []string{id}, batch, timeout)
+				if err != nil && !isNotFound(err) {
+					break
+				}
+
+				err = nil
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			return
+		}
+
+		for id, state := range batch {
+			states[id] = state
+		}
+	})
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return states, nil
+}
+
+// Helper function to describe a batch of AWS instances and record their state,
+// following the results onto any further pages.
+func describeStates(ctx context.Context, svc EC2API, ids []string, states map[string]string, timeout time.Duration) error {
+	input := &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice(ids),
+	}
+
+	// An instance should only ever be in one reservation. If AWS says
+	// otherwise, go with the last state it reported, but make some noise.
+	reserved := make(map[string]bool)
+
+	// Stopping at the first page would leave the rest of the instances
+	// looking like they no longer exist, and their nodes deletable.
+	for {
+		resp, err := describePage(ctx, svc, input, timeout, "instance_count", strconv.Itoa(len(ids)))
+		if err != nil {
+			return err
+		}
+
+		for _, reservation := range resp.Reservations {
+			seen := make(map[string]bool)
+
+			for _, instance := range reservation.Instances {
+				id := aws.StringValue(instance.InstanceId)
+
+				if reserved[id] && !seen[id] {
+					slog.Warn("Instance appears in multiple reservations, using the last state reported", "instance_id", id, "state", aws.StringValue(instance.State.Name))
+				}
+
+				seen[id] = true
+				reserved[id] = true
+
+				states[id] = aws.StringValue(instance.State.Name)
+			}
+		}
+
+		if aws.StringValue(resp.NextToken) == "" {
+			return nil
+		}
+
+		input.NextToken = resp.NextToken
+	}
+}
+
+// Helper function to describe the states of a batch of instances with
+// DescribeInstanceStatus. It only returns the state and status checks of each
+// instance, rather than everything DescribeInstances knows about it, which is
+// about a seventh of the data to download and a fifth of the time to parse
+// (see BenchmarkInstanceStates). It can't filter by tag, so lookups by tag
+// still use DescribeInstances.
+func describeStatuses(ctx context.Context, svc EC2API, ids []string, states map[string]string, timeout time.Duration) error {
+	// Without IncludeAllInstances only running instances are returned.
+	input := &ec2.DescribeInstanceStatusInput{
+		InstanceIds:         aws.StringSlice(ids),
+		IncludeAllInstances: aws.Bool(true),
+	}
+
+	for {
+		resp, err := describeStatusPage(ctx, svc, input, timeout)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range resp.InstanceStatuses {
+			states[aws.StringValue(status.InstanceId)] = aws.StringValue(status.InstanceState.Name)
+		}
+
+		if aws.StringValue(resp.NextToken) == "" {
+			return nil
+		}
+
+		input.NextToken = resp.NextToken
+	}
+}
+
+// Helper function to look up the state of every instance carrying a tag, keyed
+// by instance ID. Each page of results is given the timeout to complete.
+func taggedInstanceStates(ctx context.Context, svc EC2API, key, value string, timeout time.Duration) (map[string]string, error) {
+	states := make(map[string]string)
+
+	input := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:" + key), Values: aws.StringSlice([]string{value})},
+		},
+		MaxResults: aws.Int64(describeBatchSize * 10),
+	}
+
+	for {
+		resp, err := describePage(ctx, svc, input, timeout, "tag", "tag:"+key)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, reservation := range resp.Reservations {
+			for _, instance := range reservation.Instances {
+				states[aws.StringValue(instance.InstanceId)] = aws.StringValue(instance.State.Name)
+			}
+		}
+
+		if aws.StringValue(resp.NextToken) == "" {
+			return states, nil
+		}
+
+		input.NextToken = resp.NextToken
+	}
+}
+
+// Helper function to describe a single page of instances, giving it the
+// timeout to complete.
+func describePage(ctx context.Context, svc EC2API, input *ec2.DescribeInstancesInput, timeout time.Duration, attrs ...string) (*ec2.DescribeInstancesOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, span := startSpan(ctx, "DescribeInstances", attrs...)
+
+	resp, err := svc.DescribeInstancesWithContext(ctx, input)
+	span.End(err)
+
+	return resp, err
+}
+
+// Helper function to describe a single page of instance statuses, giving it
+// the timeout to complete.
+func describeStatusPage(ctx context.Context, svc EC2API, input *ec2.DescribeInstanceStatusInput, timeout time.Duration) (*ec2.DescribeInstanceStatusOutput, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, span := startSpan(ctx, "DescribeInstanceStatus", "instance_count", strconv.Itoa(len(input.InstanceIds)))
+
+	resp, err := svc.DescribeInstanceStatusWithContext(ctx, input)
+	span.End(err)
+
+	return resp, err
+}
+
+// Helper function to check if an instance carries a tag. Instances which AWS
+// no longer knows about can't be checked, so they are treated as tagged.
+func hasTag(ctx context.Context, svc EC2API, id, key, value string, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: aws.StringSlice([]string{id}),
+	})
+	if isNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if len(resp.Reservations) == 0 {
+		return true, nil
+	}
+
+	for _, reservation := range resp.Reservations {
+		for _, instance := range reservation.Instances {
+			for _, tag := range instance.Tags {
+				if aws.StringValue(tag.Key) == key && aws.StringValue(tag.Value) == value {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Helper function to check if an instance has termination protection enabled.
+// Instances which AWS no longer knows about aren't protected.
+func hasTerminationProtection(ctx context.Context, svc EC2API, id string, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := svc.DescribeInstanceAttributeWithContext(ctx, &ec2.DescribeInstanceAttributeInput{
+		InstanceId: aws.String(id),
+		Attribute:  aws.String(ec2.InstanceAttributeNameDisableApiTermination),
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if resp.DisableApiTermination == nil {
+		return false, nil
+	}
+
+	return aws.BoolValue(resp.DisableApiTermination.Value), nil
+}
+
+// Helper function to terminate an instance. Instances which AWS no longer knows
+// about are already gone.
+func terminateInstance(ctx context.Context, svc EC2API, id string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := svc.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: aws.StringSlice([]string{id}),
+	})
+	if isNotFound(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Helper function to check if an AWS error means the instance no longer exists.
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == errCodeInstanceNotFound
+	}
+
+	return false
+}
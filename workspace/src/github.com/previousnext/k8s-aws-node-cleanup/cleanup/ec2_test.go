@@ -0,0 +1,644 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Fake EC2 client which knows about a fixed set of instances and their state.
+type fakeEC2 struct {
+	sync.Mutex
+	instances map[string]string
+	tags      map[string]map[string]string
+	protected map[string]bool
+	calls     int
+
+	// The instance IDs asked for, across every call.
+	described []string
+
+	// How many instances to return per page, all of them when zero.
+	pageSize int
+}
+
+// Helper function to pick out the page of ids asked for by token, returning
+// the token for the next page, if there is one.
+func (f *fakeEC2) page(ids []*string, token *string) ([]*string, *string) {
+	if f.pageSize == 0 {
+		return ids, nil
+	}
+
+	var start int
+
+	if token != nil {
+		fmt.Sscanf(*token, "%d", &start)
+	}
+
+	end := start + f.pageSize
+
+	if end >= len(ids) {
+		return ids[start:], nil
+	}
+
+	return ids[start:end], aws.String(fmt.Sprint(end))
+}
+
+func (f *fakeEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls++
+	f.described = append(f.described, aws.StringValueSlice(input.InstanceIds)...)
+
+	resp := &ec2.DescribeInstancesOutput{}
+
+	ids := input.InstanceIds
+
+	// Without IDs, describe every instance matching the tag filters, in a
+	// stable order so they can be paged through.
+	if len(ids) == 0 {
+		var matched []string
+
+		for id := range f.instances {
+			if f.matches(id, input.Filters) {
+				matched = append(matched, id)
+			}
+		}
+
+		sort.Strings(matched)
+
+		ids = aws.StringSlice(matched)
+	}
+
+	ids, resp.NextToken = f.page(ids, input.NextToken)
+
+	for _, id := range ids {
+		state, ok := f.instances[*id]
+		if !ok {
+			return nil, awserr.New(errCodeInstanceNotFound, "The instance ID '"+*id+"' does not exist", nil)
+		}
+
+		instance := &ec2.Instance{
+			InstanceId: id,
+			State:      &ec2.InstanceState{Name: aws.String(state)},
+		}
+
+		for key, value := range f.tags[*id] {
+			instance.Tags = append(instance.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+
+		resp.Reservations = append(resp.Reservations, &ec2.Reservation{
+			Instances: []*ec2.Instance{instance},
+		})
+	}
+
+	return resp, nil
+}
+
+func (f *fakeEC2) matches(id string, filters []*ec2.Filter) bool {
+	for _, filter := range filters {
+		key, ok := strings.CutPrefix(aws.StringValue(filter.Name), "tag:")
+		if !ok {
+			continue
+		}
+
+		value, tagged := f.tags[id][key]
+		if !tagged || !contains(aws.StringValueSlice(filter.Values), value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *fakeEC2) DescribeInstanceStatusWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, opts ...request.Option) (*ec2.DescribeInstanceStatusOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls++
+
+	resp := &ec2.DescribeInstanceStatusOutput{}
+
+	ids, next := f.page(input.InstanceIds, input.NextToken)
+
+	resp.NextToken = next
+
+	for _, id := range ids {
+		state, ok := f.instances[*id]
+		if !ok {
+			return nil, awserr.New(errCodeInstanceNotFound, "The instance ID '"+*id+"' does not exist", nil)
+		}
+
+		// Like AWS, only running instances are returned unless asked for all.
+		if state != ec2.InstanceStateNameRunning && !aws.BoolValue(input.IncludeAllInstances) {
+			continue
+		}
+
+		resp.InstanceStatuses = append(resp.InstanceStatuses, &ec2.InstanceStatus{
+			InstanceId:    id,
+			InstanceState: &ec2.InstanceState{Name: aws.String(state)},
+		})
+	}
+
+	return resp, nil
+}
+
+func (f *fakeEC2) DescribeInstanceAttributeWithContext(ctx aws.Context, input *ec2.DescribeInstanceAttributeInput, opts ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls++
+
+	if _, ok := f.instances[*input.InstanceId]; !ok {
+		return nil, awserr.New(errCodeInstanceNotFound, "The instance ID '"+*input.InstanceId+"' does not exist", nil)
+	}
+
+	return &ec2.DescribeInstanceAttributeOutput{
+		InstanceId:            input.InstanceId,
+		DisableApiTermination: &ec2.AttributeBooleanValue{Value: aws.Bool(f.protected[*input.InstanceId])},
+	}, nil
+}
+
+// Fake EC2 client which fails every call.
+func (f *fakeEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls++
+
+	for _, id := range input.InstanceIds {
+		if _, ok := f.instances[*id]; !ok {
+			return nil, awserr.New(errCodeInstanceNotFound, "The instance ID '"+*id+"' does not exist", nil)
+		}
+
+		f.instances[*id] = ec2.InstanceStateNameShuttingDown
+	}
+
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+type failingEC2 struct {
+	err error
+}
+
+func (f *failingEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	return nil, f.err
+}
+
+func (f *failingEC2) DescribeInstanceAttributeWithContext(ctx aws.Context, input *ec2.DescribeInstanceAttributeInput, opts ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	return nil, f.err
+}
+
+func (f *failingEC2) DescribeInstanceStatusWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, opts ...request.Option) (*ec2.DescribeInstanceStatusOutput, error) {
+	return nil, f.err
+}
+
+func (f *failingEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	return nil, f.err
+}
+
+// Fake EC2 client which hangs until the call is cancelled.
+type hangingEC2 struct{}
+
+func (f *hangingEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *hangingEC2) DescribeInstanceAttributeWithContext(ctx aws.Context, input *ec2.DescribeInstanceAttributeInput, opts ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *hangingEC2) DescribeInstanceStatusWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, opts ...request.Option) (*ec2.DescribeInstanceStatusOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *hangingEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestInstanceStatesTimeout(t *testing.T) {
+	_, err := instanceStates(context.Background(), &hangingEC2{}, []string{"i-123"}, 10*time.Millisecond, 5, describeStates)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestIsDeletable(t *testing.T) {
+	deletable := []string{ec2.InstanceStateNameTerminated, ec2.InstanceStateNameShuttingDown}
+
+	assert.True(t, isDeletable(stateNotFound, deletable))
+	assert.True(t, isDeletable(ec2.InstanceStateNameTerminated, deletable))
+	assert.True(t, isDeletable(ec2.InstanceStateNameShuttingDown, deletable))
+	assert.False(t, isDeletable(ec2.InstanceStateNameStopped, deletable))
+	assert.False(t, isDeletable(ec2.InstanceStateNameRunning, deletable))
+
+	states := map[string]string{"i-123": ec2.InstanceStateNameStopped}
+	assert.Equal(t, ec2.InstanceStateNameStopped, instanceState(states, "i-123"))
+	assert.Equal(t, stateNotFound, instanceState(states, "i-456"))
+}
+
+func TestIsTransitional(t *testing.T) {
+	assert.True(t, isTransitional(ec2.InstanceStateNamePending))
+	assert.True(t, isTransitional(ec2.InstanceStateNameStopping))
+	assert.True(t, isTransitional(ec2.InstanceStateNameShuttingDown))
+	assert.False(t, isTransitional(ec2.InstanceStateNameTerminated))
+	assert.False(t, isTransitional(ec2.InstanceStateNameStopped))
+	assert.False(t, isTransitional(stateNotFound))
+}
+
+func TestCountStates(t *testing.T) {
+	nodes := []v1.Node{
+		{Spec: v1.NodeSpec{ExternalID: "i-running"}},
+		{Spec: v1.NodeSpec{ExternalID: "i-running2"}},
+		{Spec: v1.NodeSpec{ExternalID: "i-stopped"}},
+		{Spec: v1.NodeSpec{ExternalID: "i-gone"}},
+		{Spec: v1.NodeSpec{}},
+	}
+
+	states := map[string]string{
+		"i-running":  ec2.InstanceStateNameRunning,
+		"i-running2": ec2.InstanceStateNameRunning,
+		"i-stopped":  ec2.InstanceStateNameStopped,
+	}
+
+	assert.Equal(t, map[string]int{
+		ec2.InstanceStateNameRunning: 2,
+		ec2.InstanceStateNameStopped: 1,
+		stateNotFound:                1,
+		stateUnknown:                 1,
+	}, countStates(nodes, states, map[string]RegionClient{"ap-southeast-2": {EC2: &fakeEC2{}}}))
+}
+
+func TestHasTag(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-tagged":   ec2.InstanceStateNameTerminated,
+			"i-untagged": ec2.InstanceStateNameTerminated,
+			"i-other":    ec2.InstanceStateNameTerminated,
+		},
+		tags: map[string]map[string]string{
+			"i-tagged": {"KubernetesCluster": "prod"},
+			"i-other":  {"KubernetesCluster": "dev"},
+		},
+	}
+
+	tests := map[string]bool{
+		"i-tagged":   true,
+		"i-untagged": false,
+		"i-other":    false,
+		"i-gone":     true,
+	}
+
+	for id, want := range tests {
+		tagged, err := hasTag(context.Background(), svc, id, "KubernetesCluster", "prod", time.Second)
+		assert.Nil(t, err, id)
+		assert.Equal(t, want, tagged, id)
+	}
+
+	_, err := hasTag(context.Background(), &failingEC2{err: fmt.Errorf("boom")}, "i-tagged", "KubernetesCluster", "prod", time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestHasTerminationProtection(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-protected":   ec2.InstanceStateNameStopped,
+			"i-unprotected": ec2.InstanceStateNameStopped,
+		},
+		protected: map[string]bool{"i-protected": true},
+	}
+
+	tests := map[string]bool{
+		"i-protected":   true,
+		"i-unprotected": false,
+		"i-gone":        false,
+	}
+
+	for id, want := range tests {
+		protected, err := hasTerminationProtection(context.Background(), svc, id, time.Second)
+		assert.Nil(t, err, id)
+		assert.Equal(t, want, protected, id)
+	}
+
+	_, err := hasTerminationProtection(context.Background(), &failingEC2{err: fmt.Errorf("boom")}, "i-protected", time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestTerminateInstance(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{"i-stopped": ec2.InstanceStateNameStopped},
+	}
+
+	err := terminateInstance(context.Background(), svc, "i-stopped", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, ec2.InstanceStateNameShuttingDown, svc.instances["i-stopped"])
+
+	// Instances which are already gone don't need terminating.
+	err = terminateInstance(context.Background(), svc, "i-gone", time.Second)
+	assert.Nil(t, err)
+
+	err = terminateInstance(context.Background(), &failingEC2{err: fmt.Errorf("boom")}, "i-stopped", time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestInstanceStates(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-running":    ec2.InstanceStateNameRunning,
+			"i-stopped":    ec2.InstanceStateNameStopped,
+			"i-terminated": ec2.InstanceStateNameTerminated,
+		},
+	}
+
+	states, err := instanceStates(context.Background(), svc, []string{"i-running", "i-stopped", "i-terminated", "i-deregistered"}, time.Second, 5, describeStates)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"i-running":    ec2.InstanceStateNameRunning,
+		"i-stopped":    ec2.InstanceStateNameStopped,
+		"i-terminated": ec2.InstanceStateNameTerminated,
+	}, states)
+
+	// A deregistered instance is not running, so its node gets deleted.
+	assert.NotEqual(t, ec2.InstanceStateNameRunning, states["i-deregistered"])
+}
+
+func TestInstanceStatesDescribeStatus(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-running":    ec2.InstanceStateNameRunning,
+			"i-stopped":    ec2.InstanceStateNameStopped,
+			"i-terminated": ec2.InstanceStateNameTerminated,
+		},
+	}
+
+	states, err := instanceStates(context.Background(), svc, []string{"i-running", "i-stopped", "i-terminated", "i-deregistered"}, time.Second, 5, describeStatuses)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"i-running":    ec2.InstanceStateNameRunning,
+		"i-stopped":    ec2.InstanceStateNameStopped,
+		"i-terminated": ec2.InstanceStateNameTerminated,
+	}, states)
+
+	_, err = instanceStates(context.Background(), &hangingEC2{}, []string{"i-123"}, 10*time.Millisecond, 5, describeStatuses)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestInstanceStatesBatched(t *testing.T) {
+	svc := &fakeEC2{
+		instances: make(map[string]string),
+	}
+
+	var ids []string
+
+	for i := 0; i < 250; i++ {
+		id := fmt.Sprintf("i-%d", i)
+		svc.instances[id] = ec2.InstanceStateNameRunning
+		ids = append(ids, id)
+	}
+
+	states, err := instanceStates(context.Background(), svc, ids, time.Second, 5, describeStates)
+	assert.Nil(t, err)
+	assert.Len(t, states, 250)
+	assert.Equal(t, 3, svc.calls)
+}
+
+func TestInstanceStatesPaginated(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-running":    ec2.InstanceStateNameRunning,
+			"i-stopped":    ec2.InstanceStateNameStopped,
+			"i-terminated": ec2.InstanceStateNameTerminated,
+		},
+		pageSize: 1,
+	}
+
+	want := map[string]string{
+		"i-running":    ec2.InstanceStateNameRunning,
+		"i-stopped":    ec2.InstanceStateNameStopped,
+		"i-terminated": ec2.InstanceStateNameTerminated,
+	}
+
+	// Instances on later pages must not look like they are gone.
+	for name, describe := range map[string]describeFunc{"DescribeInstances": describeStates, "DescribeInstanceStatus": describeStatuses} {
+		svc.calls = 0
+
+		states, err := instanceStates(context.Background(), svc, []string{"i-running", "i-stopped", "i-terminated"}, time.Second, 5, describe)
+		assert.Nil(t, err, name)
+		assert.Equal(t, want, states, name)
+		assert.Equal(t, 3, svc.calls, name)
+	}
+}
+
+func TestDescribeStatesDuplicates(t *testing.T) {
+	var buf bytes.Buffer
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	svc := &fakeEC2{
+		instances: map[string]string{"i-1": ec2.InstanceStateNameRunning},
+	}
+
+	// The fake returns a reservation for every ID it is asked about.
+	states := make(map[string]string)
+
+	err := describeStates(context.Background(), svc, []string{"i-1", "i-1"}, states, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"i-1": ec2.InstanceStateNameRunning}, states)
+	assert.Contains(t, buf.String(), "Instance appears in multiple reservations")
+
+	// Duplicate IDs are only described once.
+	buf.Reset()
+
+	states, err = instanceStates(context.Background(), svc, []string{"i-1", "i-1"}, time.Second, 5, describeStates)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"i-1": ec2.InstanceStateNameRunning}, states)
+	assert.Empty(t, buf.String())
+}
+
+func TestTaggedInstanceStates(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-running": ec2.InstanceStateNameRunning,
+			"i-stopped": ec2.InstanceStateNameStopped,
+			"i-other":   ec2.InstanceStateNameRunning,
+		},
+		tags: map[string]map[string]string{
+			"i-running": {"cluster": "prod"},
+			"i-stopped": {"cluster": "prod"},
+			"i-other":   {"cluster": "staging"},
+		},
+	}
+
+	states, err := taggedInstanceStates(context.Background(), svc, "cluster", "prod", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"i-running": ec2.InstanceStateNameRunning,
+		"i-stopped": ec2.InstanceStateNameStopped,
+	}, states)
+
+	// Every page is followed, however the results are split up.
+	svc.pageSize = 1
+	svc.calls = 0
+
+	states, err = taggedInstanceStates(context.Background(), svc, "cluster", "prod", time.Second)
+	assert.Nil(t, err)
+	assert.Len(t, states, 2)
+	assert.Equal(t, 2, svc.calls)
+
+	_, err = taggedInstanceStates(context.Background(), &failingEC2{err: fmt.Errorf("boom")}, "cluster", "prod", time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestIsMismatched(t *testing.T) {
+	tests := map[string]bool{
+		ec2.InstanceStateNameRunning:      false,
+		ec2.InstanceStateNamePending:      false,
+		stateUnknown:                      false,
+		stateUnchecked:                    false,
+		ec2.InstanceStateNameStopped:      true,
+		ec2.InstanceStateNameTerminated:   true,
+		ec2.InstanceStateNameShuttingDown: true,
+		stateNotFound:                     true,
+	}
+
+	for state, want := range tests {
+		assert.Equal(t, want, isMismatched(state), state)
+	}
+}
+
+func TestUniqueIDs(t *testing.T) {
+	assert.Equal(t, []string{"i-1", "i-2", "i-3"}, uniqueIDs([]string{"i-1", "i-2", "i-1", "i-3", "i-2"}))
+	assert.Nil(t, uniqueIDs(nil))
+}
+
+func TestInstanceStatesError(t *testing.T) {
+	svc := &failingEC2{
+		err: awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil),
+	}
+
+	_, err := instanceStates(context.Background(), svc, []string{"i-123"}, time.Second, 5, describeStates)
+	assert.NotNil(t, err)
+}
+
+// A single instance as DescribeInstances returns it, trimmed of the fields
+// which are usually empty.
+const benchInstanceXML = `<item><reservationId>r-0123456789abcdef0</reservationId><ownerId>123456789012</ownerId><groupSet/><instancesSet><item>
+<instanceId>%s</instanceId><imageId>ami-0123456789abcdef0</imageId><instanceState><code>16</code><name>running</name></instanceState>
+<privateDnsName>ip-10-0-1-23.ap-southeast-2.compute.internal</privateDnsName><dnsName/><reason/><keyName>kubernetes</keyName><amiLaunchIndex>0</amiLaunchIndex>
+<productCodes/><instanceType>m5.xlarge</instanceType><launchTime>2017-08-01T10:00:00.000Z</launchTime>
+<placement><availabilityZone>ap-southeast-2a</availabilityZone><groupName/><tenancy>default</tenancy></placement>
+<monitoring><state>disabled</state></monitoring><subnetId>subnet-0123456789abcdef0</subnetId><vpcId>vpc-0123456789abcdef0</vpcId>
+<privateIpAddress>10.0.1.23</privateIpAddress><sourceDestCheck>false</sourceDestCheck>
+<groupSet><item><groupId>sg-0123456789abcdef0</groupId><groupName>nodes.k8s.example.com</groupName></item></groupSet>
+<architecture>x86_64</architecture><rootDeviceType>ebs</rootDeviceType><rootDeviceName>/dev/xvda</rootDeviceName>
+<blockDeviceMapping><item><deviceName>/dev/xvda</deviceName><ebs><volumeId>vol-0123456789abcdef0</volumeId><status>attached</status>
+<attachTime>2017-08-01T10:00:01.000Z</attachTime><deleteOnTermination>true</deleteOnTermination></ebs></item></blockDeviceMapping>
+<virtualizationType>hvm</virtualizationType><clientToken>0123456789abcdef</clientToken>
+<tagSet><item><key>Name</key><value>nodes.k8s.example.com</value></item><item><key>KubernetesCluster</key><value>k8s.example.com</value></item>
+<item><key>aws:autoscaling:groupName</key><value>nodes.k8s.example.com</value></item><item><key>k8s.io/role/node</key><value>1</value></item></tagSet>
+<hypervisor>xen</hypervisor><networkInterfaceSet><item><networkInterfaceId>eni-0123456789abcdef0</networkInterfaceId><subnetId>subnet-0123456789abcdef0</subnetId>
+<vpcId>vpc-0123456789abcdef0</vpcId><description/><ownerId>123456789012</ownerId><status>in-use</status><macAddress>02:00:00:00:00:01</macAddress>
+<privateIpAddress>10.0.1.23</privateIpAddress><privateDnsName>ip-10-0-1-23.ap-southeast-2.compute.internal</privateDnsName><sourceDestCheck>false</sourceDestCheck>
+<groupSet><item><groupId>sg-0123456789abcdef0</groupId><groupName>nodes.k8s.example.com</groupName></item></groupSet>
+<attachment><attachmentId>eni-attach-0123456789abcdef0</attachmentId><deviceIndex>0</deviceIndex><status>attached</status>
+<attachTime>2017-08-01T10:00:00.000Z</attachTime><deleteOnTermination>true</deleteOnTermination></attachment>
+<privateIpAddressesSet><item><privateIpAddress>10.0.1.23</privateIpAddress><privateDnsName>ip-10-0-1-23.ap-southeast-2.compute.internal</privateDnsName><primary>true</primary></item></privateIpAddressesSet>
+<ipv6AddressesSet/></item></networkInterfaceSet><iamInstanceProfile><arn>arn:aws:iam::123456789012:instance-profile/nodes.k8s.example.com</arn><id>AIPA0123456789ABCDEF0</id></iamInstanceProfile>
+<ebsOptimized>false</ebsOptimized><enaSupport>true</enaSupport></item></instancesSet></item>`
+
+// A single instance as DescribeInstanceStatus returns it.
+const benchStatusXML = `<item><instanceId>%s</instanceId><availabilityZone>ap-southeast-2a</availabilityZone>
+<instanceState><code>16</code><name>running</name></instanceState>
+<systemStatus><status>ok</status><details><item><name>reachability</name><status>passed</status></item></details></systemStatus>
+<instanceStatus><status>ok</status><details><item><name>reachability</name><status>passed</status></item></details></instanceStatus></item>`
+
+// Compares looking up the states of a cluster's worth of instances with
+// DescribeInstances and DescribeInstanceStatus, against canned AWS responses.
+// Run with: go test -run NONE -bench InstanceStates
+func BenchmarkInstanceStates(b *testing.B) {
+	var ids []string
+
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, fmt.Sprintf("i-%017x", i))
+	}
+
+	// The response for every batch is the same size, so canned IDs will do.
+	respond := func(name, set, item string) string {
+		var body strings.Builder
+
+		fmt.Fprintf(&body, `<%sResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><requestId>0</requestId><%s>`, name, set)
+
+		for _, id := range ids[:describeBatchSize] {
+			fmt.Fprintf(&body, item, id)
+		}
+
+		fmt.Fprintf(&body, `</%s></%sResponse>`, set, name)
+
+		return body.String()
+	}
+
+	responses := map[string]string{
+		"DescribeInstances":      respond("DescribeInstances", "reservationSet", benchInstanceXML),
+		"DescribeInstanceStatus": respond("DescribeInstanceStatus", "instanceStatusSet", benchStatusXML),
+	}
+
+	for name, describe := range map[string]describeFunc{"DescribeInstances": describeStates, "DescribeInstanceStatus": describeStatuses} {
+		b.Run(name, func(b *testing.B) {
+			var sent int
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sent += len(responses[name])
+				w.Write([]byte(responses[name]))
+			}))
+			defer server.Close()
+
+			sess := session.New(&aws.Config{
+				Region:      aws.String("ap-southeast-2"),
+				Endpoint:    aws.String(server.URL),
+				Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			})
+			svc := ec2.New(sess)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				states, err := instanceStates(context.Background(), svc, ids, time.Second, 1, describe)
+				if err != nil || len(states) != describeBatchSize {
+					b.Fatal(len(states), err)
+				}
+			}
+
+			b.ReportMetric(float64(sent)/float64(b.N), "resp-bytes/op")
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package cleanup
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracks the progress of the cleanup loop for liveness and readiness probes.
+type health struct {
+	sync.Mutex
+
+	// How long we can go without making progress before we are unhealthy.
+	timeout time.Duration
+
+	started      bool
+	standby      bool
+	listed       bool
+	lastProgress time.Time
+}
+
+// Started records that the cleanup loop is running.
+func (h *health) Started(timeout time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.started = true
+	h.standby = false
+	h.timeout = timeout
+	h.lastProgress = time.Now()
+}
+
+// Standby records that we are waiting to become the leader, so we don't
+// expect any reconciles to happen.
+func (h *health) Standby() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.started = true
+	h.standby = true
+}
+
+// Listed records that we have successfully listed the nodes in the cluster.
+func (h *health) Listed() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.listed = true
+}
+
+// Succeeded records that a reconcile pass has completed.
+func (h *health) Succeeded() {
+	h.Progressed()
+}
+
+// Progressed records that the cleanup loop is still getting somewhere, part way
+// through a long pass or after deliberately cutting one short.
+func (h *health) Progressed() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.lastProgress = time.Now()
+}
+
+// Healthz reports whether the cleanup loop is running and has made progress
+// recently, so Kubernetes can restart a stuck pod.
+func (h *health) Healthz(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.started {
+		http.Error(w, "cleanup loop has not started", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !h.standby && time.Since(h.lastProgress) > h.timeout {
+		http.Error(w, "no progress since "+h.lastProgress.Format(time.RFC3339), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// Readyz reports whether we have been able to list the nodes in the cluster.
+func (h *health) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+
+	if !h.listed {
+		http.Error(w, "nodes have not been listed", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// Healthz serves the liveness of the cleanup loop.
+func (r *Reconciler) Healthz(w http.ResponseWriter, req *http.Request) {
+	r.health.Healthz(w, req)
+}
+
+// Readyz serves the readiness of the cleanup loop.
+func (r *Reconciler) Readyz(w http.ResponseWriter, req *http.Request) {
+	r.health.Readyz(w, req)
+}
+
+// Standby records that we are waiting to become the leader before calling
+// Run, so we stay healthy in the meantime.
+func (r *Reconciler) Standby() {
+	r.health.Standby()
+}
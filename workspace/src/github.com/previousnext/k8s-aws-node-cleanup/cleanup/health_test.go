@@ -0,0 +1,51 @@
+package cleanup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	h := &health{}
+
+	status := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, status(h.Healthz))
+	assert.Equal(t, http.StatusServiceUnavailable, status(h.Readyz))
+
+	h.Started(time.Minute)
+	assert.Equal(t, http.StatusOK, status(h.Healthz))
+	assert.Equal(t, http.StatusServiceUnavailable, status(h.Readyz))
+
+	h.Listed()
+	assert.Equal(t, http.StatusOK, status(h.Readyz))
+
+	// Pretend the last successful reconcile was a long time ago.
+	h.lastProgress = time.Now().Add(-time.Hour)
+	assert.Equal(t, http.StatusServiceUnavailable, status(h.Healthz))
+
+	h.Succeeded()
+	assert.Equal(t, http.StatusOK, status(h.Healthz))
+
+	// Progress part way through a pass counts too.
+	h.lastProgress = time.Now().Add(-time.Hour)
+	h.Progressed()
+	assert.Equal(t, http.StatusOK, status(h.Healthz))
+}
+
+func TestHealthStandby(t *testing.T) {
+	h := &health{}
+	h.Standby()
+
+	w := httptest.NewRecorder()
+	h.Healthz(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
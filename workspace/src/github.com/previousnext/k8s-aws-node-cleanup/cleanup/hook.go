@@ -0,0 +1,55 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The most output from a hook we include in an error.
+const hookOutputLimit = 1024
+
+// Helper function to run an executable before a node is deleted, with the node
+// name and instance ID as arguments and in the environment. The node must not
+// be deleted unless it exits cleanly before the timeout.
+func runPreDelete(ctx context.Context, path string, timeout time.Duration, c candidate) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, c.node.ObjectMeta.Name, c.instanceID)
+	cmd.Env = append(os.Environ(),
+		"NODE_NAME="+c.node.ObjectMeta.Name,
+		"INSTANCE_ID="+c.instanceID,
+		"INSTANCE_STATE="+c.state,
+		"REGION="+c.region,
+	)
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, hookOutput(output.String()))
+	}
+
+	return nil
+}
+
+// Helper function to trim a hook's output down to something fit for a log line.
+func hookOutput(output string) string {
+	output = strings.TrimSpace(output)
+
+	if len(output) > hookOutputLimit {
+		output = output[:hookOutputLimit] + "..."
+	}
+
+	return output
+}
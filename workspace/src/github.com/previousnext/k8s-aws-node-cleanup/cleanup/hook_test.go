@@ -0,0 +1,54 @@
+package cleanup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Helper function to write an executable script for a test.
+func writeHook(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "hook.sh")
+
+	err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700)
+	assert.Nil(t, err)
+
+	return path
+}
+
+func TestRunPreDelete(t *testing.T) {
+	c := candidate{
+		node:       v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		instanceID: "i-123",
+		region:     "ap-southeast-2",
+		state:      "terminated",
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+
+	hook := writeHook(t, `echo "$1 $2 $NODE_NAME $INSTANCE_ID $INSTANCE_STATE $REGION" > `+out)
+
+	err := runPreDelete(context.Background(), hook, time.Second, c)
+	assert.Nil(t, err)
+
+	written, err := os.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "node1 i-123 node1 i-123 terminated ap-southeast-2\n", string(written))
+
+	err = runPreDelete(context.Background(), writeHook(t, "echo snapshot failed >&2; exit 3"), time.Second, c)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "snapshot failed")
+
+	err = runPreDelete(context.Background(), writeHook(t, "sleep 5"), 50*time.Millisecond, c)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+
+	err = runPreDelete(context.Background(), filepath.Join(t.TempDir(), "missing"), time.Second, c)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,82 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// A page of nodes. The ListOptions and ListMeta in this version of client-go
+// predate the limit and continue fields, so pages are requested and decoded
+// by hand.
+type nodePage struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+		Continue        string `json:"continue"`
+	} `json:"metadata"`
+	Items []v1.Node `json:"items"`
+}
+
+// Helper function to list all the nodes matching a label selector, and the
+// resource version of the list. When a page size is given the nodes are
+// fetched in pages of that size, following the continue token until every
+// page has been read.
+func listNodes(clientset kubernetes.Interface, selector string, pageSize int64) ([]v1.Node, string, error) {
+	if pageSize <= 0 {
+		list, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{
+			LabelSelector: selector,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+
+		return list.Items, list.ListMeta.ResourceVersion, nil
+	}
+
+	var (
+		nodes   []v1.Node
+		token   string
+		version string
+	)
+
+	for {
+		req := clientset.CoreV1().RESTClient().Get().Resource("nodes").Param("limit", strconv.FormatInt(pageSize, 10))
+
+		if selector != "" {
+			req = req.Param("labelSelector", selector)
+		}
+
+		if token != "" {
+			req = req.Param("continue", token)
+		}
+
+		raw, err := req.DoRaw()
+		if err != nil {
+			return nil, "", err
+		}
+
+		var page nodePage
+
+		err = json.Unmarshal(raw, &page)
+		if err != nil {
+			return nil, "", err
+		}
+
+		nodes = append(nodes, page.Items...)
+
+		// Every page is served from the snapshot the first was taken from.
+		if version == "" {
+			version = page.Metadata.ResourceVersion
+		}
+
+		// Servers which don't support paging send everything in one go.
+		if page.Metadata.Continue == "" {
+			return nodes, version, nil
+		}
+
+		token = page.Metadata.Continue
+	}
+}
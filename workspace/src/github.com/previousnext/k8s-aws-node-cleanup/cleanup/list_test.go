@@ -0,0 +1,60 @@
+package cleanup
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+)
+
+func TestListNodesPaged(t *testing.T) {
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Query().Get("continue") {
+		case "":
+			fmt.Fprint(w, `{"kind":"NodeList","apiVersion":"v1","metadata":{"resourceVersion":"123","continue":"page2"},"items":[{"metadata":{"name":"node1"}},{"metadata":{"name":"node2"}}]}`)
+		case "page2":
+			fmt.Fprint(w, `{"kind":"NodeList","apiVersion":"v1","metadata":{"resourceVersion":"123"},"items":[{"metadata":{"name":"node3"}}]}`)
+		}
+	}))
+	defer server.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.Nil(t, err)
+
+	nodes, version, err := listNodes(clientset, "pool=spot", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "123", version)
+
+	var names []string
+
+	for _, node := range nodes {
+		names = append(names, node.ObjectMeta.Name)
+	}
+
+	assert.Equal(t, []string{"node1", "node2", "node3"}, names)
+	assert.Equal(t, []string{
+		"labelSelector=pool%3Dspot&limit=2",
+		"continue=page2&labelSelector=pool%3Dspot&limit=2",
+	}, requests)
+}
+
+func TestListNodesUnpaged(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+
+	nodes, _, err := listNodes(clientset, "", 0)
+	assert.Nil(t, err)
+	assert.Len(t, nodes, 1)
+}
@@ -0,0 +1,98 @@
+package cleanup
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Stages of a reconcile pass which can fail.
+const (
+	stageList      = "list"
+	stageDescribe  = "describe"
+	stageDrain     = "drain"
+	stagePreDelete = "pre-delete"
+	stageSafety    = "safety"
+	stageDelete    = "delete"
+	stageCordon    = "cordon"
+	stageTerminate = "terminate"
+	stageReport    = "report"
+)
+
+var (
+	metricNodesDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nodes_deleted_total",
+		Help: "Number of nodes which have been deleted.",
+	})
+	metricDeletedNotReadyAge = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "deleted_node_notready_age_seconds",
+		Help: "How long nodes had been not ready for when they were deleted, for tuning the grace periods.",
+		// From a minute to a week, nodes are rarely deleted sooner or later.
+		Buckets: []float64{60, 300, 600, 1800, 3600, 2 * 3600, 6 * 3600, 12 * 3600, 24 * 3600, 2 * 24 * 3600, 7 * 24 * 3600},
+	})
+	metricNodesInspected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nodes_inspected_total",
+		Help: "Number of nodes which have been inspected for cleanup.",
+	})
+	metricStuckDeletions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "stuck_deletions_total",
+		Help: "Number of failed deletions of nodes which have failed to delete too many times in a row.",
+	})
+	metricNodeStateMismatch = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "node_state_mismatch_total",
+		Help: "Number of times a node reported ready while its instance was not running.",
+	})
+	metricReconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reconcile_errors_total",
+		Help: "Number of errors encountered while reconciling, by stage.",
+	}, []string{"stage"})
+	metricNodesByState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nodes_by_instance_state",
+		Help: "Number of nodes backed by an instance in each state, as of the last reconcile pass.",
+	}, []string{"state"})
+	metricLastReconcile = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "last_reconcile_timestamp_seconds",
+		Help: "Unix timestamp of the last completed reconcile pass.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricNodesDeleted,
+		metricDeletedNotReadyAge,
+		metricNodesInspected,
+		metricStuckDeletions,
+		metricNodeStateMismatch,
+		metricReconcileErrors,
+		metricNodesByState,
+		metricLastReconcile,
+	)
+}
+
+// Helper function to record how long a node had been not ready for when it was
+// deleted. Nodes which never posted a Ready condition have nothing to go on.
+func observeNotReadyAge(node v1.Node, required []ConditionSpec, now time.Time) {
+	since := notReadySince(node.Status.Conditions, required)
+	if since.IsZero() {
+		return
+	}
+
+	metricDeletedNotReadyAge.Observe(now.Sub(since).Seconds())
+}
+
+// Helper function to publish how many nodes are backed by each instance
+// state. States which disappear are dropped, except for the common ones which
+// are always reported so dashboards show zero rather than a gap.
+func setNodesByState(counts map[string]int) {
+	metricNodesByState.Reset()
+
+	for _, state := range []string{ec2.InstanceStateNameRunning, ec2.InstanceStateNameStopped, ec2.InstanceStateNameTerminated, stateNotFound, stateUnknown} {
+		metricNodesByState.WithLabelValues(state).Set(0)
+	}
+
+	for state, count := range counts {
+		metricNodesByState.WithLabelValues(state).Set(float64(count))
+	}
+}
@@ -0,0 +1,34 @@
+package cleanup
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestObserveNotReadyAge(t *testing.T) {
+	var before, after dto.Metric
+
+	err := metricDeletedNotReadyAge.Write(&before)
+	assert.Nil(t, err)
+
+	now := time.Now()
+
+	node := *testNode("node1", "i-terminated", v1.ConditionFalse)
+	node.Status.Conditions[0].LastTransitionTime = metav1.NewTime(now.Add(-time.Hour))
+
+	observeNotReadyAge(node, nil, now)
+
+	// Without a Ready condition there is nothing to observe.
+	observeNotReadyAge(v1.Node{}, nil, now)
+
+	err = metricDeletedNotReadyAge.Write(&after)
+	assert.Nil(t, err)
+
+	assert.Equal(t, before.GetHistogram().GetSampleCount()+1, after.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 3600, after.GetHistogram().GetSampleSum()-before.GetHistogram().GetSampleSum(), 1)
+}
@@ -0,0 +1,363 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Helper function to check if a Kubernetes node is a control plane node, or
+// carries any of the given labels (as key or key=value).
+func isProtected(node v1.Node, labels []string) bool {
+	for _, label := range append([]string{labelRoleMaster, labelRoleControlPlane}, labels...) {
+		key, value, hasValue := strings.Cut(label, "=")
+
+		actual, ok := node.ObjectMeta.Labels[key]
+		if !ok {
+			continue
+		}
+
+		if !hasValue || actual == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TaintSpec is a taint which protects nodes carrying it. The value and effect
+// only need to match when they are set.
+type TaintSpec struct {
+	Key      string
+	Value    string
+	HasValue bool
+	Effect   v1.TaintEffect
+}
+
+// ParseTaints parses and validates taints in the form key[=value][:effect].
+func ParseTaints(specs []string) ([]TaintSpec, error) {
+	var taints []TaintSpec
+
+	for _, spec := range specs {
+		rest, effect, hasEffect := strings.Cut(spec, ":")
+		key, value, hasValue := strings.Cut(rest, "=")
+
+		if key == "" {
+			return nil, fmt.Errorf("taint has no key: %s", spec)
+		}
+
+		taint := TaintSpec{Key: key, Value: value, HasValue: hasValue}
+
+		if hasEffect {
+			switch v1.TaintEffect(effect) {
+			case v1.TaintEffectNoSchedule, v1.TaintEffectPreferNoSchedule, v1.TaintEffectNoExecute:
+				taint.Effect = v1.TaintEffect(effect)
+			default:
+				return nil, fmt.Errorf("unknown taint effect: %s", spec)
+			}
+		}
+
+		taints = append(taints, taint)
+	}
+
+	return taints, nil
+}
+
+// Helper function to check if a node carries any of the given taints.
+func hasTaint(node v1.Node, taints []TaintSpec) bool {
+	for _, want := range taints {
+		for _, taint := range node.Spec.Taints {
+			if taint.Key != want.Key {
+				continue
+			}
+
+			if want.HasValue && taint.Value != want.Value {
+				continue
+			}
+
+			if want.Effect != "" && taint.Effect != want.Effect {
+				continue
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Helper function to record why a node is about to be deleted, and when.
+func annotateNode(clientset kubernetes.Interface, name, reason string, now time.Time) error {
+	return patchAnnotations(clientset, name, map[string]interface{}{
+		annotationReason:    reason,
+		annotationDeletedAt: now.UTC().Format(time.RFC3339),
+	})
+}
+
+// Helper function to find when a node was annotated as pending deletion. Nodes
+// whose annotation can't be parsed are treated as not pending, so they are
+// annotated again.
+func pendingDeleteSince(node v1.Node) (time.Time, bool) {
+	value, ok := node.ObjectMeta.Annotations[AnnotationPendingDelete]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return since, true
+}
+
+// Helper function to record when a node first qualified for deletion.
+func markPendingDelete(clientset kubernetes.Interface, name string, now time.Time) error {
+	return patchAnnotations(clientset, name, map[string]interface{}{
+		AnnotationPendingDelete: now.UTC().Format(time.RFC3339),
+	})
+}
+
+// Helper function to remove the record of a node qualifying for deletion.
+func unmarkPendingDelete(clientset kubernetes.Interface, name string) error {
+	// A null value removes the annotation in a merge patch.
+	return patchAnnotations(clientset, name, map[string]interface{}{
+		AnnotationPendingDelete: nil,
+	})
+}
+
+// Helper function to cordon a node. Only the one field is patched, so the
+// node doesn't need to be fresh, and fields this client doesn't know about are
+// left alone.
+func cordonNode(clientset kubernetes.Interface, name string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"unschedulable": true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().Nodes().Patch(name, types.MergePatchType, patch)
+
+	return err
+}
+
+// Helper function to cordon a node and label it as a candidate for deletion.
+func cordonCandidate(clientset kubernetes.Interface, name string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{
+				LabelCandidate: "true",
+			},
+		},
+		"spec": map[string]interface{}{
+			"unschedulable": true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().Nodes().Patch(name, types.MergePatchType, patch)
+
+	return err
+}
+
+// Helper function to set (or with a nil value, remove) annotations on a node.
+func patchAnnotations(clientset kubernetes.Interface, name string, annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = clientset.CoreV1().Nodes().Patch(name, types.MergePatchType, patch)
+
+	return err
+}
+
+// Helper function to describe why a node was deleted, given the state of its
+// instance.
+func deletionReason(state string) string {
+	if state == stateUnchecked {
+		return "node has not been ready for longer than the grace period"
+	}
+
+	return "node is not ready and its instance is " + state
+}
+
+// Returned for nodes which aren't backed by an EC2 instance, such as those
+// with neither an ExternalID nor a ProviderID, or Fargate nodes.
+var errNoInstanceID = errors.New("node has no instance ID")
+
+// Helper function to determine the ID of the AWS instance backing a node. The
+// deprecated ExternalID is preferred when it holds an instance ID, which it
+// doesn't always (it can be the hostname), newer clusters only set a ProviderID
+// in the form aws:///<zone>/<instance id>.
+func instanceID(node v1.Node) (string, error) {
+	if strings.HasPrefix(node.Spec.ExternalID, "i-") {
+		return node.Spec.ExternalID, nil
+	}
+
+	if node.Spec.ProviderID == "" {
+		return "", errNoInstanceID
+	}
+
+	if !strings.HasPrefix(node.Spec.ProviderID, "aws://") {
+		return "", fmt.Errorf("unsupported provider ID: %s", node.Spec.ProviderID)
+	}
+
+	id := node.Spec.ProviderID[strings.LastIndex(node.Spec.ProviderID, "/")+1:]
+	if id == "" {
+		return "", fmt.Errorf("cannot find instance ID in provider ID: %s", node.Spec.ProviderID)
+	}
+
+	// Fargate nodes, for example, are aws:///<zone>/<id>/fargate-ip-<address>.
+	if !strings.HasPrefix(id, "i-") {
+		return "", errNoInstanceID
+	}
+
+	return id, nil
+}
+
+// ConditionSpec is a node condition which must be healthy, as well as Ready,
+// for a node to be left alone.
+type ConditionSpec struct {
+	Type    v1.NodeConditionType
+	Healthy v1.ConditionStatus
+}
+
+// Conditions which are healthy when False, rather than True.
+var healthyWhenFalse = map[v1.NodeConditionType]bool{
+	v1.NodeOutOfDisk:          true,
+	v1.NodeMemoryPressure:     true,
+	v1.NodeDiskPressure:       true,
+	v1.NodeInodePressure:      true,
+	v1.NodeNetworkUnavailable: true,
+	"PIDPressure":             true,
+}
+
+// ParseConditions parses and validates a comma separated list of node
+// conditions in the form type[=status], where status is the healthy one.
+// Without a status, the built in pressure and NetworkUnavailable conditions
+// are healthy when False, and every other condition when True.
+func ParseConditions(list string) ([]ConditionSpec, error) {
+	var conditions []ConditionSpec
+
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		name, status, hasStatus := strings.Cut(spec, "=")
+
+		if name == "" {
+			return nil, fmt.Errorf("condition has no type: %s", spec)
+		}
+
+		condition := ConditionSpec{Type: v1.NodeConditionType(name), Healthy: v1.ConditionTrue}
+
+		if healthyWhenFalse[condition.Type] {
+			condition.Healthy = v1.ConditionFalse
+		}
+
+		if hasStatus {
+			switch v1.ConditionStatus(status) {
+			case v1.ConditionTrue, v1.ConditionFalse:
+				condition.Healthy = v1.ConditionStatus(status)
+			default:
+				return nil, fmt.Errorf("healthy condition status must be True or False: %s", spec)
+			}
+		}
+
+		conditions = append(conditions, condition)
+	}
+
+	return conditions, nil
+}
+
+// Helper function to find the first of the required conditions which a node
+// reports as unhealthy. Conditions the node doesn't report at all are not
+// held against it, plenty of clusters never set some of them.
+func failedCondition(conditions []v1.NodeCondition, required []ConditionSpec) (v1.NodeCondition, bool) {
+	for _, want := range required {
+		for _, condition := range conditions {
+			if condition.Type == want.Type && condition.Status != want.Healthy {
+				return condition, true
+			}
+		}
+	}
+
+	return v1.NodeCondition{}, false
+}
+
+// Helper function to decide from its "Ready" condition, and any other required
+// conditions, whether a node should be considered for cleanup, along with the
+// reason. That is when the Ready condition is False, Unknown because the
+// kubelet has stopped posting status, or missing because the kubelet never
+// posted any, or when a required condition is unhealthy.
+func shouldConsiderForCleanup(node v1.Node, required []ConditionSpec) (bool, string) {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != v1.NodeReady {
+			continue
+		}
+
+		reason := fmt.Sprintf("NodeReady=%s", condition.Status)
+
+		if condition.Status == v1.ConditionFalse || condition.Status == v1.ConditionUnknown {
+			return true, reason
+		}
+
+		if failed, ok := failedCondition(node.Status.Conditions, required); ok {
+			return true, fmt.Sprintf("%s=%s", failed.Type, failed.Status)
+		}
+
+		return false, reason
+	}
+
+	return true, "no Ready condition"
+}
+
+// Helper function to find when the node became unhealthy. That is when its
+// Ready condition last changed, unless it is Ready and a required condition
+// has failed since.
+func notReadySince(conditions []v1.NodeCondition, required []ConditionSpec) time.Time {
+	for _, condition := range conditions {
+		if condition.Type != v1.NodeReady {
+			continue
+		}
+
+		if condition.Status == v1.ConditionTrue {
+			if failed, ok := failedCondition(conditions, required); ok {
+				return failed.LastTransitionTime.Time
+			}
+		}
+
+		return condition.LastTransitionTime.Time
+	}
+
+	return time.Time{}
+}
+
+// Helper function to find when the kubelet last posted the node's Ready condition.
+func lastHeartbeat(conditions []v1.NodeCondition) time.Time {
+	for _, condition := range conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.LastHeartbeatTime.Time
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,303 @@
+package cleanup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	core "k8s.io/client-go/testing"
+)
+
+func TestIsProtected(t *testing.T) {
+	node := func(labels map[string]string) v1.Node {
+		return v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: labels}}
+	}
+
+	assert.False(t, isProtected(node(nil), nil))
+	assert.True(t, isProtected(node(map[string]string{labelRoleMaster: ""}), nil))
+	assert.True(t, isProtected(node(map[string]string{labelRoleControlPlane: ""}), nil))
+	assert.True(t, isProtected(node(map[string]string{"pool": "infra"}), []string{"pool"}))
+	assert.True(t, isProtected(node(map[string]string{"pool": "infra"}), []string{"pool=infra"}))
+	assert.False(t, isProtected(node(map[string]string{"pool": "spot"}), []string{"pool=infra"}))
+}
+
+func TestHasTaint(t *testing.T) {
+	node := v1.Node{
+		Spec: v1.NodeSpec{
+			Taints: []v1.Taint{{Key: "dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule}},
+		},
+	}
+
+	tests := map[string]bool{
+		"dedicated":                   true,
+		"dedicated=gpu":               true,
+		"dedicated=gpu:NoSchedule":    true,
+		"dedicated:NoSchedule":        true,
+		"dedicated=cpu":               false,
+		"dedicated=gpu:NoExecute":     false,
+		"lifecycle":                   false,
+		"dedicated=:PreferNoSchedule": false,
+	}
+
+	for spec, want := range tests {
+		taints, err := ParseTaints([]string{spec})
+		assert.Nil(t, err, spec)
+		assert.Equal(t, want, hasTaint(node, taints), spec)
+	}
+
+	assert.False(t, hasTaint(node, nil))
+}
+
+func TestParseTaints(t *testing.T) {
+	taints, err := ParseTaints([]string{"lifecycle", "pool=infra", "dedicated=gpu:NoSchedule", "draining:NoExecute"})
+	assert.Nil(t, err)
+	assert.Equal(t, []TaintSpec{
+		{Key: "lifecycle"},
+		{Key: "pool", Value: "infra", HasValue: true},
+		{Key: "dedicated", Value: "gpu", HasValue: true, Effect: v1.TaintEffectNoSchedule},
+		{Key: "draining", Effect: v1.TaintEffectNoExecute},
+	}, taints)
+
+	_, err = ParseTaints([]string{"=infra"})
+	assert.NotNil(t, err)
+
+	_, err = ParseTaints([]string{"pool=infra:NoSuchEffect"})
+	assert.NotNil(t, err)
+}
+
+func TestInstanceID(t *testing.T) {
+	tests := []struct {
+		spec v1.NodeSpec
+		id   string
+		err  bool
+	}{
+		{spec: v1.NodeSpec{ExternalID: "i-123", ProviderID: "aws:///us-east-1a/i-456"}, id: "i-123"},
+		{spec: v1.NodeSpec{ExternalID: "ip-10-0-0-1.ec2.internal", ProviderID: "aws:///us-east-1a/i-456"}, id: "i-456"},
+		{spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0abc123"}, id: "i-0abc123"},
+		{spec: v1.NodeSpec{}, err: true},
+		{spec: v1.NodeSpec{ProviderID: "gce://project/zone/node1"}, err: true},
+		{spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/"}, err: true},
+	}
+
+	for _, test := range tests {
+		id, err := instanceID(v1.Node{Spec: test.spec})
+		assert.Equal(t, test.id, id)
+		assert.Equal(t, test.err, err != nil)
+	}
+
+	_, err := instanceID(v1.Node{})
+	assert.Equal(t, errNoInstanceID, err)
+
+	// Neither hostnames nor Fargate pods are instances.
+	_, err = instanceID(v1.Node{Spec: v1.NodeSpec{ExternalID: "ip-10-0-0-1.ec2.internal"}})
+	assert.Equal(t, errNoInstanceID, err)
+
+	_, err = instanceID(v1.Node{Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/0123456789abcdef/fargate-ip-10-0-0-1.ec2.internal"}})
+	assert.Equal(t, errNoInstanceID, err)
+}
+
+func TestShouldConsiderForCleanup(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []v1.NodeCondition
+		required   []ConditionSpec
+		consider   bool
+		reason     string
+	}{
+		{
+			name:       "ready",
+			conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+			consider:   false,
+			reason:     "NodeReady=True",
+		},
+		{
+			name:       "not ready",
+			conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}},
+			consider:   true,
+			reason:     "NodeReady=False",
+		},
+		{
+			name:       "unknown",
+			conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionUnknown}},
+			consider:   true,
+			reason:     "NodeReady=Unknown",
+		},
+		{
+			name:       "unexpected status",
+			conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ""}},
+			consider:   false,
+			reason:     "NodeReady=",
+		},
+		{
+			name:       "missing",
+			conditions: []v1.NodeCondition{{Type: v1.NodeOutOfDisk, Status: v1.ConditionFalse}},
+			consider:   true,
+			reason:     "no Ready condition",
+		},
+		{
+			name:     "no conditions",
+			consider: true,
+			reason:   "no Ready condition",
+		},
+		{
+			name: "ready with other conditions failing",
+			conditions: []v1.NodeCondition{
+				{Type: v1.NodeOutOfDisk, Status: v1.ConditionTrue},
+				{Type: v1.NodeMemoryPressure, Status: v1.ConditionTrue},
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			},
+			consider: false,
+			reason:   "NodeReady=True",
+		},
+		{
+			name: "not ready with other conditions passing",
+			conditions: []v1.NodeCondition{
+				{Type: v1.NodeOutOfDisk, Status: v1.ConditionFalse},
+				{Type: v1.NodeReady, Status: v1.ConditionFalse},
+			},
+			consider: true,
+			reason:   "NodeReady=False",
+		},
+		{
+			name: "ready with a required condition failing",
+			conditions: []v1.NodeCondition{
+				{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue},
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			},
+			required: []ConditionSpec{{Type: v1.NodeNetworkUnavailable, Healthy: v1.ConditionFalse}},
+			consider: true,
+			reason:   "NetworkUnavailable=True",
+		},
+		{
+			name: "ready with a required condition unknown",
+			conditions: []v1.NodeCondition{
+				{Type: "GPUHealthy", Status: v1.ConditionUnknown},
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			},
+			required: []ConditionSpec{{Type: "GPUHealthy", Healthy: v1.ConditionTrue}},
+			consider: true,
+			reason:   "GPUHealthy=Unknown",
+		},
+		{
+			name: "ready with required conditions passing or missing",
+			conditions: []v1.NodeCondition{
+				{Type: "GPUHealthy", Status: v1.ConditionTrue},
+				{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			},
+			required: []ConditionSpec{
+				{Type: "GPUHealthy", Healthy: v1.ConditionTrue},
+				{Type: v1.NodeNetworkUnavailable, Healthy: v1.ConditionFalse},
+			},
+			consider: false,
+			reason:   "NodeReady=True",
+		},
+	}
+
+	for _, test := range tests {
+		consider, reason := shouldConsiderForCleanup(v1.Node{Status: v1.NodeStatus{Conditions: test.conditions}}, test.required)
+		assert.Equal(t, test.consider, consider, test.name)
+		assert.Equal(t, test.reason, reason, test.name)
+	}
+}
+
+func TestNotReadySince(t *testing.T) {
+	transition := time.Now().Add(-10 * time.Minute)
+
+	conditions := []v1.NodeCondition{
+		{Type: v1.NodeOutOfDisk, Status: v1.ConditionFalse},
+		{Type: v1.NodeReady, Status: v1.ConditionFalse, LastTransitionTime: metav1.NewTime(transition)},
+	}
+
+	assert.Equal(t, transition, notReadySince(conditions, nil))
+	assert.True(t, notReadySince(nil, nil).IsZero())
+
+	// A ready node has been unhealthy since its required condition failed.
+	failed := time.Now().Add(-5 * time.Minute)
+
+	conditions = []v1.NodeCondition{
+		{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue, LastTransitionTime: metav1.NewTime(failed)},
+		{Type: v1.NodeReady, Status: v1.ConditionTrue, LastTransitionTime: metav1.NewTime(transition)},
+	}
+
+	required := []ConditionSpec{{Type: v1.NodeNetworkUnavailable, Healthy: v1.ConditionFalse}}
+
+	assert.Equal(t, failed, notReadySince(conditions, required))
+	assert.Equal(t, transition, notReadySince(conditions, nil))
+}
+
+func TestParseConditions(t *testing.T) {
+	conditions, err := ParseConditions("NetworkUnavailable, GPUHealthy,Maintenance=False,,DiskPressure=True")
+	assert.Nil(t, err)
+	assert.Equal(t, []ConditionSpec{
+		{Type: v1.NodeNetworkUnavailable, Healthy: v1.ConditionFalse},
+		{Type: "GPUHealthy", Healthy: v1.ConditionTrue},
+		{Type: "Maintenance", Healthy: v1.ConditionFalse},
+		{Type: v1.NodeDiskPressure, Healthy: v1.ConditionTrue},
+	}, conditions)
+
+	conditions, err = ParseConditions("")
+	assert.Nil(t, err)
+	assert.Empty(t, conditions)
+
+	_, err = ParseConditions("=True")
+	assert.NotNil(t, err)
+
+	_, err = ParseConditions("GPUHealthy=Unknown")
+	assert.NotNil(t, err)
+}
+
+func TestLastHeartbeat(t *testing.T) {
+	heartbeat := time.Now().Add(-30 * time.Second)
+
+	conditions := []v1.NodeCondition{
+		{Type: v1.NodeOutOfDisk, Status: v1.ConditionFalse, LastHeartbeatTime: metav1.NewTime(time.Now())},
+		{Type: v1.NodeReady, Status: v1.ConditionFalse, LastHeartbeatTime: metav1.NewTime(heartbeat)},
+	}
+
+	assert.Equal(t, heartbeat, lastHeartbeat(conditions))
+	assert.True(t, lastHeartbeat(nil).IsZero())
+}
+
+func TestAnnotateNode(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+
+	// The fake clientset can't apply patches, so record them instead.
+	var patches []string
+
+	clientset.PrependReactor("patch", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		patches = append(patches, string(action.(core.PatchActionImpl).GetPatch()))
+		return true, &v1.Node{}, nil
+	})
+
+	now := time.Date(2017, time.August, 1, 10, 30, 0, 0, time.UTC)
+
+	err := annotateNode(clientset, "node1", deletionReason(ec2.InstanceStateNameTerminated), now)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		`{"metadata":{"annotations":{"k8s-aws-cleanup/deleted-at":"2017-08-01T10:30:00Z","k8s-aws-cleanup/reason":"node is not ready and its instance is terminated"}}}`,
+	}, patches)
+}
+
+func TestPendingDeleteSince(t *testing.T) {
+	node := *testNode("node", "i-node", v1.ConditionFalse)
+
+	_, ok := pendingDeleteSince(node)
+	assert.False(t, ok)
+
+	node.ObjectMeta.Annotations = map[string]string{AnnotationPendingDelete: "yesterday"}
+
+	_, ok = pendingDeleteSince(node)
+	assert.False(t, ok)
+
+	node.ObjectMeta.Annotations[AnnotationPendingDelete] = "2017-08-01T10:00:00Z"
+
+	since, ok := pendingDeleteSince(node)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC), since)
+}
@@ -0,0 +1,42 @@
+package cleanup
+
+import (
+	"time"
+)
+
+// Notifications configure who hears about passes and deleted nodes, beyond the
+// events recorded in the cluster. Each is disabled when left empty.
+type Notifications struct {
+	// A Slack incoming webhook to post deleted nodes to.
+	SlackWebhook string
+
+	// A URL to POST each deleted node to as JSON, signed with the secret
+	// when one is set, and the name of the cluster to include.
+	WebhookURL     string
+	WebhookSecret  string
+	WebhookTimeout time.Duration
+	ClusterName    string
+
+	// A file to record deletion decisions in as JSON lines, rotated once it
+	// grows past the maximum size in bytes.
+	AuditLog        string
+	AuditLogMaxSize int64
+
+	// A Prometheus Pushgateway to push the time of each successful pass to,
+	// grouped by instance.
+	PushgatewayURL string
+	Instance       string
+
+	// An OTLP/HTTP collector to export a trace of each pass to.
+	OtelEndpoint string
+}
+
+// Close waits for anything still being sent to the notifiers, and closes the
+// audit log. It should be called before exiting, once passes have stopped.
+func (r *Reconciler) Close() {
+	r.tracing.Wait()
+	r.pusher.Wait()
+	r.audit.Close()
+	r.webhook.Wait()
+	r.slack.Wait()
+}
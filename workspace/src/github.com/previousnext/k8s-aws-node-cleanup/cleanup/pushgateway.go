@@ -0,0 +1,121 @@
+package cleanup
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// How long to wait for the Pushgateway to accept our metrics.
+const pushgatewayTimeout = 10 * time.Second
+
+// Pushes a dead man's switch metric to a Prometheus Pushgateway in the
+// background, so a slow or broken gateway never holds up node cleanup.
+type pushgateway struct {
+	url      string
+	instance string
+	client   *http.Client
+	wg       sync.WaitGroup
+	busy     int32
+}
+
+// Helper function to tell the Pushgateway about successful passes, when a URL
+// has been configured.
+func newPushgateway(n Notifications) *pushgateway {
+	return &pushgateway{
+		url:      n.PushgatewayURL,
+		instance: n.Instance,
+		client:   &http.Client{Timeout: pushgatewayTimeout},
+	}
+}
+
+// Succeeded pushes the time of a successful reconcile pass. A push is skipped
+// if the previous one is still in flight, rather than piling up.
+func (p *pushgateway) Succeeded(now time.Time) {
+	if p.url == "" {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&p.busy, 0, 1) {
+		slog.Warn("Previous push to the Pushgateway has not finished, skipping")
+		return
+	}
+
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+		defer atomic.StoreInt32(&p.busy, 0)
+
+		err := p.push(now)
+		if err != nil {
+			slog.Error("Failed to push to the Pushgateway", "error", err)
+		}
+	}()
+}
+
+// Wait blocks until the last push has finished.
+func (p *pushgateway) Wait() {
+	p.wg.Wait()
+}
+
+func (p *pushgateway) push(now time.Time) error {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "last_success_timestamp",
+		Help: "Unix timestamp of the last successful reconcile pass.",
+	})
+	gauge.Set(float64(now.Unix()))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(gauge)
+
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+
+	encoder := expfmt.NewEncoder(&body, expfmt.FmtText)
+
+	for _, family := range families {
+		err := encoder.Encode(family)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Replace everything previously pushed for this job and instance.
+	endpoint := fmt.Sprintf("%s/metrics/job/%s", strings.TrimSuffix(p.url, "/"), url.PathEscape(Component))
+	if p.instance != "" {
+		endpoint += "/instance/" + url.PathEscape(p.instance)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, endpoint, &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
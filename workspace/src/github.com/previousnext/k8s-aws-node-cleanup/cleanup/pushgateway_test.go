@@ -0,0 +1,38 @@
+package cleanup
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushgateway(t *testing.T) {
+	var (
+		paths  []string
+		bodies []string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, string(body))
+	}))
+	defer server.Close()
+
+	p := &pushgateway{url: server.URL + "/", instance: "node-cleanup-1", client: server.Client()}
+	p.Succeeded(time.Unix(1501583400, 0))
+	p.Wait()
+
+	assert.Equal(t, []string{"PUT /metrics/job/k8s-aws-node-cleanup/instance/node-cleanup-1"}, paths)
+	assert.Contains(t, bodies[0], "last_success_timestamp 1.5015834e+09")
+}
+
+func TestPushgatewayDisabled(t *testing.T) {
+	p := &pushgateway{client: http.DefaultClient}
+	p.Succeeded(time.Now())
+	p.Wait()
+}
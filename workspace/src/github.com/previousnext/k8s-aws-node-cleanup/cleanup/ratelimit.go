@@ -0,0 +1,47 @@
+package cleanup
+
+import (
+	"math"
+	"time"
+)
+
+// Limits how fast nodes are deleted across passes. Tokens refill at a steady
+// rate, up to a minute's worth, so a quiet spell allows a short burst but a
+// sustained scale down can't go any faster than the rate.
+type tokenBucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+// Helper function to build a full bucket which refills at perMinute tokens a
+// minute, holding at least one.
+func newTokenBucket(perMinute float64, now time.Time) *tokenBucket {
+	burst := math.Max(1, math.Ceil(perMinute))
+
+	return &tokenBucket{
+		perSecond: perMinute / 60,
+		burst:     burst,
+		tokens:    burst,
+		last:      now,
+	}
+}
+
+// Take takes up to n whole tokens, returning how many it got.
+func (b *tokenBucket) Take(n int, now time.Time) int {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.perSecond)
+		b.last = now
+	}
+
+	taken := int(math.Min(float64(n), math.Floor(b.tokens)))
+	b.tokens -= float64(taken)
+
+	return taken
+}
+
+// Return gives back n tokens which were taken but not used, up to the burst.
+func (b *tokenBucket) Return(n int) {
+	b.tokens = math.Min(b.burst, b.tokens+float64(n))
+}
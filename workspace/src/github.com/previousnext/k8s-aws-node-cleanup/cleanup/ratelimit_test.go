@@ -0,0 +1,35 @@
+package cleanup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+
+	// Starts with a minute's worth of tokens.
+	b := newTokenBucket(3, now)
+	assert.Equal(t, 2, b.Take(2, now))
+	assert.Equal(t, 1, b.Take(5, now))
+	assert.Equal(t, 0, b.Take(1, now))
+
+	// Refills a token every 20 seconds, but no more than a minute's worth.
+	assert.Equal(t, 0, b.Take(1, now.Add(10*time.Second)))
+	assert.Equal(t, 1, b.Take(5, now.Add(20*time.Second)))
+	assert.Equal(t, 3, b.Take(5, now.Add(time.Hour)))
+
+	// Tokens which go unused can be taken again, but don't overfill the bucket.
+	b.Return(2)
+	assert.Equal(t, 2, b.Take(5, now.Add(time.Hour)))
+	b.Return(5)
+	assert.Equal(t, 3, b.Take(5, now.Add(time.Hour)))
+
+	// Slower rates still allow a single deletion at a time.
+	b = newTokenBucket(0.5, now)
+	assert.Equal(t, 1, b.Take(2, now))
+	assert.Equal(t, 0, b.Take(1, now.Add(time.Minute)))
+	assert.Equal(t, 1, b.Take(1, now.Add(2*time.Minute)))
+}
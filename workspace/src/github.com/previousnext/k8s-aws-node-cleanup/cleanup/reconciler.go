@@ -0,0 +1,1365 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Options control how often the Reconciler runs and which nodes it deletes.
+type Options struct {
+	// How often to run a pass, how far to back off while the APIs we depend
+	// on are unavailable, and the fraction of the interval to randomly
+	// adjust it by.
+	Frequency           time.Duration
+	FrequencyMaxBackoff time.Duration
+	Jitter              float64
+
+	// How soon to take another look at nodes which hit an error during a
+	// pass, rather than waiting for the next pass. Disabled when zero.
+	ErrorRequeue time.Duration
+
+	// Which nodes to list, and how many at a time.
+	Selector     string
+	ListPageSize int64
+
+	// Describe the instances carrying this tag, rather than the instance
+	// behind each node. Nodes whose instance isn't among them are treated
+	// as gone.
+	InstanceTagKey   string
+	InstanceTagValue string
+
+	// Look up instance states with DescribeInstanceStatus, rather than
+	// DescribeInstances.
+	DescribeStatus bool
+
+	// Nodes which are never deleted.
+	NodeNameFilter *regexp.Regexp
+	ProtectLabels  []string
+	ProtectTaints  []TaintSpec
+	SkipAnnotation string
+
+	// How old a node must be, how long it must have been not ready, and how
+	// long since the kubelet last posted its status, before it is
+	// considered for cleanup.
+	MinAge         time.Duration
+	NotReadyGrace  time.Duration
+	HeartbeatGrace time.Duration
+
+	// Conditions which must be healthy, as well as Ready, for a node to be
+	// treated as ready.
+	RequireConditions []ConditionSpec
+
+	// Delete not ready nodes without looking up their instances at all, going
+	// on the grace periods alone.
+	SkipInstanceCheck bool
+
+	// How old a not ready node must be to be deleted even when its instance
+	// can't be looked up. Disabled when zero.
+	NodeAgeMax time.Duration
+
+	// How long AWS must have consistently reported a node's instance as not
+	// found before the node is deleted. DescribeInstances is eventually
+	// consistent, so instances can briefly go missing. Disabled when zero.
+	NotFoundGrace time.Duration
+
+	// The instances whose nodes may be deleted.
+	DeletableStates   []string
+	CheckASGLifecycle bool
+	RespectProtection bool
+
+	// Terminate stopped instances and delete their nodes, where they would
+	// otherwise be left alone.
+	TerminateStopped bool
+
+	// Leave nodes alone while their instance is pending, stopping or
+	// shutting down, even if the state is deletable.
+	SkipTransitional bool
+
+	// Checks a node and its instance must pass before the node is deleted.
+	// Instances of the named cluster carry the kubernetes.io/cluster/<name>
+	// tag, set to owned.
+	RequireTagKey   string
+	RequireTagValue string
+	RequireEmpty    bool
+	ClusterName     string
+
+	// How many consecutive passes a node must fail before it is deleted.
+	Confirmations int
+
+	// Annotate nodes the first time they qualify for deletion, and only
+	// delete them once they have still qualified after waiting this long.
+	AnnotateThenWait  bool
+	PendingDeleteWait time.Duration
+
+	// Safety limits on how many nodes a single pass may delete, and how many
+	// nodes must be listed for a pass to delete any.
+	MaxDeletions        int
+	MaxDeletionFraction float64
+	MinExpectedNodes    int
+
+	// How many nodes may be deleted a minute, across passes, allowing bursts
+	// of up to a minute's worth. Disabled when zero.
+	DeleteRate float64
+
+	// How many AWS and Kubernetes calls to make in parallel, and how long
+	// to wait for each of them.
+	Concurrency    int
+	RequestTimeout time.Duration
+
+	// An executable to run before each node is deleted, which can stop the
+	// deletion by failing, and how long to give it.
+	PreDeleteExec    string
+	PreDeleteTimeout time.Duration
+
+	// Only cordon and label candidates, leaving someone to review and delete
+	// them. Nothing is drained, terminated or deleted.
+	CordonOnly bool
+
+	// Whether to cordon and evict pods before deleting nodes, and whether
+	// to delete them anyway when that takes too long.
+	Drain        bool
+	DrainTimeout time.Duration
+	DrainForce   bool
+
+	// How nodes are deleted. The API server's defaults are used when the
+	// grace period is nil or the propagation policy is empty.
+	DeleteGracePeriod *int64
+	DeletePropagation metav1.DeletionPropagation
+
+	// How many times to retry deleting a node while the API server is
+	// throttling us.
+	DeleteRetries int
+
+	// How many times in a row a node may fail to delete before we escalate,
+	// for example when a finalizer is stuck. Disabled when zero.
+	MaxDeleteFailures int
+
+	// How long to leave a node alone after deleting it, while it may still
+	// be on its way out.
+	DeleteCooldown time.Duration
+
+	// Only log which nodes would have been deleted.
+	DryRun bool
+
+	// A file to write the candidates of each pass to as JSON.
+	ReportFile string
+
+	// Log routine skips, such as of ready nodes, at debug level.
+	Quiet bool
+
+	// Log a single line listing the nodes deleted by each pass, with the
+	// details of each deletion at debug level.
+	SummarizeDeletions bool
+
+	// Who hears about passes and deleted nodes, beyond the events recorded
+	// in the cluster.
+	Notifications Notifications
+}
+
+// Reconciler deletes nodes whose backing EC2 instances have gone away.
+type Reconciler struct {
+	clients   map[string]RegionClient
+	clientset kubernetes.Interface
+	recorder  record.EventRecorder
+	opts      Options
+
+	// How many consecutive passes each node has failed, keyed by node name.
+	failures map[string]int
+
+	// Nodes which hit an error during the last pass, keyed by node name.
+	requeue map[string]bool
+
+	// How many consecutive attempts to delete each node have failed, keyed
+	// by node name.
+	deleteFailures map[string]int
+
+	// When each recently deleted node was deleted, keyed by node name.
+	deletedAt map[string]time.Time
+
+	// When AWS first reported each node's instance as not found, keyed by
+	// node name, while it still does.
+	notFoundSince map[string]time.Time
+
+	// Throttles deletions across passes, when a rate has been set.
+	deleteLimit *tokenBucket
+
+	// The last pass to run.
+	last summary
+
+	// How the cleanup loop is going, for the health and status endpoints.
+	health *health
+	status *status
+
+	// Who to tell about passes and deleted nodes.
+	slack   *slackNotifier
+	webhook *webhookNotifier
+	audit   *auditLog
+	pusher  *pushgateway
+	tracing *tracer
+
+	// Requests to run a pass out of band, and whether Run is around to
+	// answer them.
+	triggers chan chan PassReport
+	running  atomic.Bool
+}
+
+// New builds a Reconciler for the nodes in a cluster, looking up their
+// instances with the AWS clients for each region. Close should be called once
+// it is no longer needed.
+func New(clients map[string]RegionClient, clientset kubernetes.Interface, recorder record.EventRecorder, opts Options) (*Reconciler, error) {
+	err := ValidateOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleteLimit *tokenBucket
+
+	if opts.DeleteRate > 0 {
+		deleteLimit = newTokenBucket(opts.DeleteRate, time.Now())
+	}
+
+	return &Reconciler{
+		clients:        clients,
+		clientset:      clientset,
+		recorder:       recorder,
+		opts:           opts,
+		failures:       make(map[string]int),
+		requeue:        make(map[string]bool),
+		deleteFailures: make(map[string]int),
+		deletedAt:      make(map[string]time.Time),
+		notFoundSince:  make(map[string]time.Time),
+		deleteLimit:    deleteLimit,
+		triggers:       make(chan chan PassReport),
+		health:         &health{},
+		status:         &status{},
+		slack:          newSlackNotifier(opts.Notifications),
+		webhook:        newWebhookNotifier(opts.Notifications),
+		audit:          newAuditLog(opts.Notifications),
+		pusher:         newPushgateway(opts.Notifications),
+		tracing:        newTracer(opts.Notifications),
+	}, nil
+}
+
+// ValidateOptions checks the options which have no sensible zero value, as New
+// does.
+func ValidateOptions(opts Options) error {
+	if opts.Frequency <= 0 {
+		return fmt.Errorf("frequency must be greater than 0: %s", opts.Frequency)
+	}
+
+	if opts.Jitter < 0 || opts.Jitter >= 1 {
+		return fmt.Errorf("jitter must be at least 0 and less than 1: %v", opts.Jitter)
+	}
+
+	if opts.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1: %d", opts.Concurrency)
+	}
+
+	if opts.RequestTimeout <= 0 {
+		return fmt.Errorf("request timeout must be greater than 0: %s", opts.RequestTimeout)
+	}
+
+	return nil
+}
+
+// Run performs a cleanup pass every interval until the context is cancelled.
+func (r *Reconciler) Run(ctx context.Context) error {
+	// Only started once a pass leaves nodes to take another look at.
+	requeue := time.NewTimer(r.opts.ErrorRequeue)
+	requeue.Stop()
+
+	r.health.Started(r.livenessTimeout())
+
+	r.running.Store(true)
+	defer r.running.Store(false)
+
+	// Nodes are most likely to have piled up while we were restarting, so
+	// don't leave them for a whole interval. Triggers wait for this pass.
+	err := r.Reconcile(ctx)
+
+	interval := nextInterval(r.opts.Frequency, r.opts.Frequency, r.opts.FrequencyMaxBackoff, IsUnavailable(err))
+
+	limiter := time.NewTimer(jittered(interval, r.opts.Jitter))
+
+	for {
+		// There is no point retrying sooner while the APIs are unavailable,
+		// the backoff takes care of that.
+		if r.opts.ErrorRequeue > 0 && len(r.requeue) > 0 && !IsUnavailable(err) {
+			requeue.Reset(r.opts.ErrorRequeue)
+		} else {
+			requeue.Stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			slog.Info("shutting down")
+			return nil
+		case reply := <-r.triggers:
+			// Everyone who asked while we were busy shares a single pass.
+			replies := []chan PassReport{reply}
+
+			for queued := true; queued; {
+				select {
+				case reply := <-r.triggers:
+					replies = append(replies, reply)
+				default:
+					queued = false
+				}
+			}
+
+			slog.Info("Running a triggered pass", "requests", len(replies))
+
+			err = r.Reconcile(ctx)
+
+			report := r.last.Report(r.opts.DryRun, err)
+
+			for _, reply := range replies {
+				reply <- report
+			}
+		case <-requeue.C:
+			slog.Info("Retrying nodes which hit an error during the last pass", "nodes", len(r.requeue))
+
+			// Errors have already been logged, we will try again next pass.
+			err = r.Retry(ctx)
+		case <-limiter.C:
+			// Errors have already been logged, we will try again next pass.
+			err = r.Reconcile(ctx)
+
+			// Go easy on the Kubernetes and AWS APIs while they are struggling.
+			interval = nextInterval(interval, r.opts.Frequency, r.opts.FrequencyMaxBackoff, IsUnavailable(err))
+
+			limiter.Reset(jittered(interval, r.opts.Jitter))
+		}
+	}
+}
+
+// Helper function to work out how long Run can go without making progress
+// before it is stuck: two of the longest intervals it backs off to, plus
+// however long a single node may take to run its pre-delete hook and drain.
+func (r *Reconciler) livenessTimeout() time.Duration {
+	interval := r.opts.Frequency
+	if r.opts.FrequencyMaxBackoff > interval {
+		interval = r.opts.FrequencyMaxBackoff
+	}
+
+	timeout := 2 * interval
+
+	if r.opts.PreDeleteExec != "" {
+		timeout += r.opts.PreDeleteTimeout
+	}
+
+	if r.opts.Drain {
+		timeout += r.opts.DrainTimeout
+	}
+
+	return timeout
+}
+
+// ErrNotRunning is returned when a pass is triggered while Run isn't running,
+// for example on a standby waiting to become the leader.
+var ErrNotRunning = errors.New("cleanup loop is not running")
+
+// Trigger asks Run to perform a pass as soon as it can, and waits for it to
+// finish. Requests which arrive while a pass is running share the next one.
+func (r *Reconciler) Trigger(ctx context.Context) (PassReport, error) {
+	if !r.running.Load() {
+		return PassReport{}, ErrNotRunning
+	}
+
+	reply := make(chan PassReport, 1)
+
+	select {
+	case r.triggers <- reply:
+	case <-ctx.Done():
+		return PassReport{}, ctx.Err()
+	}
+
+	select {
+	case report := <-reply:
+		return report, nil
+	case <-ctx.Done():
+		return PassReport{}, ctx.Err()
+	}
+}
+
+// Returned by Reconcile when the Kubernetes or AWS APIs couldn't be reached to
+// list nodes or describe instances, so no nodes could be inspected.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+// IsUnavailable checks if a reconcile pass failed because the APIs we depend
+// on were unavailable.
+func IsUnavailable(err error) bool {
+	var unavailable *unavailableError
+	return errors.As(err, &unavailable)
+}
+
+// Returned when a pass ran to the end, but some nodes couldn't be inspected or
+// deleted.
+type partialError struct {
+	err error
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error()
+}
+
+// IsPartial checks if a reconcile pass only failed for some nodes.
+func IsPartial(err error) bool {
+	var partial *partialError
+	return errors.As(err, &partial)
+}
+
+// Reconcile performs a single cleanup pass, deleting nodes which are not ready
+// and whose instances are no longer running.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	ctx, span := r.tracing.Start(ctx, "reconcile")
+	err := r.reconcile(ctx, nil)
+	span.End(err)
+
+	r.status.Finished(r.last.Report(r.opts.DryRun, err))
+
+	return err
+}
+
+// Retry performs a pass over only the nodes which hit an error during the
+// last pass.
+func (r *Reconciler) Retry(ctx context.Context) error {
+	ctx, span := r.tracing.Start(ctx, "retry")
+	err := r.reconcile(ctx, r.requeue)
+	span.End(err)
+
+	r.status.Finished(r.last.Report(r.opts.DryRun, err))
+
+	return err
+}
+
+// ReconcileOnce performs a single cleanup pass for callers which exit
+// afterwards, eg. a CronJob. Nodes which couldn't be inspected don't fail the
+// pass as a whole, but are still reported as an error which IsPartial
+// recognises.
+func (r *Reconciler) ReconcileOnce(ctx context.Context) error {
+	err := r.Reconcile(ctx)
+	if err == nil && r.last.errors > 0 {
+		err = &partialError{fmt.Errorf("failed to inspect %d nodes", r.last.errors)}
+	}
+
+	return err
+}
+
+// Helper function to perform a cleanup pass over the nodes in only, or every
+// node when it is nil.
+func (r *Reconciler) reconcile(ctx context.Context, only map[string]bool) error {
+	pass := summary{started: time.Now(), errored: make(map[string]bool)}
+	defer pass.Log()
+
+	defer func() {
+		r.last = pass
+	}()
+
+	_, span := r.tracing.Start(ctx, "list nodes")
+	nodes, version, err := listNodes(r.clientset, r.opts.Selector, r.opts.ListPageSize)
+	span.End(err)
+
+	if err != nil {
+		slog.Error("Failed to lookup node list", "error", err)
+		metricReconcileErrors.WithLabelValues(stageList).Inc()
+		r.status.Failed(stageList, err)
+		pass.errors++
+		return &unavailableError{fmt.Errorf("failed to lookup node list: %v", err)}
+	}
+
+	r.health.Listed()
+
+	pass.resourceVersion = version
+
+	// A list much smaller than usual is more likely a degraded view of the
+	// cluster, for example during an apiserver roll, than real nodes.
+	if len(nodes) < r.opts.MinExpectedNodes {
+		err := fmt.Errorf("listed %d nodes, fewer than the minimum expected of %d", len(nodes), r.opts.MinExpectedNodes)
+
+		slog.Warn("FEWER NODES LISTED THAN EXPECTED, NOT DELETING ANY", "listed", len(nodes), "min_expected_nodes", r.opts.MinExpectedNodes, "resource_version", version)
+		metricReconcileErrors.WithLabelValues(stageSafety).Inc()
+		r.status.Failed(stageSafety, err)
+		pass.errors++
+
+		// Holding back is the loop working as intended, restarting us
+		// wouldn't change anything.
+		r.health.Progressed()
+
+		return err
+	}
+
+	// Whatever happens from here, these are the nodes worth another look.
+	defer func() {
+		r.requeue = pass.errored
+	}()
+
+	// Look up all the instances backing our nodes in as few calls as
+	// possible, in the region each of them is in.
+	ids := make(map[string][]string)
+
+	for _, node := range nodes {
+		if r.opts.SkipInstanceCheck {
+			break
+		}
+
+		if only != nil && !only[node.ObjectMeta.Name] {
+			continue
+		}
+
+		id, err := instanceID(node)
+		if err != nil {
+			continue
+		}
+
+		region, err := nodeRegion(node, r.clients)
+		if err != nil {
+			continue
+		}
+
+		ids[region] = append(ids[region], id)
+	}
+
+	var (
+		states = make(map[string]string)
+		groups = make(map[string]asgInstance)
+
+		// Regions whose instances couldn't be looked up, and the error to
+		// fail the pass with once the ancient nodes in them are dealt with.
+		describeErrs = make(map[string]error)
+		describeErr  error
+	)
+
+	for region, regionIDs := range ids {
+		client := r.clients[region]
+
+		// Stale registrations can leave two nodes backed by the same instance.
+		regionIDs = uniqueIDs(regionIDs)
+
+		var regionStates map[string]string
+
+		if r.opts.InstanceTagKey != "" {
+			regionStates, err = taggedInstanceStates(ctx, client.EC2, r.opts.InstanceTagKey, r.opts.InstanceTagValue, r.opts.RequestTimeout)
+		} else if r.opts.DescribeStatus {
+			regionStates, err = instanceStates(ctx, client.EC2, regionIDs, r.opts.RequestTimeout, r.opts.Concurrency, describeStatuses)
+		} else {
+			regionStates, err = instanceStates(ctx, client.EC2, regionIDs, r.opts.RequestTimeout, r.opts.Concurrency, describeStates)
+		}
+
+		if err != nil {
+			slog.Error("Failed to lookup instance states", "region", region, "error", err)
+			metricReconcileErrors.WithLabelValues(stageDescribe).Inc()
+			r.status.Failed(stageDescribe, err)
+			pass.errors++
+			describeErrs[region] = err
+			describeErr = &unavailableError{fmt.Errorf("failed to lookup instance states in %s: %v", region, err)}
+			continue
+		}
+
+		for id, state := range regionStates {
+			states[id] = state
+		}
+
+		// Instances can still be running in EC2 while their Auto Scaling
+		// group is terminating them, or be protected from scale in by their
+		// group.
+		if client.ASG == nil {
+			continue
+		}
+
+		regionGroups, err := asgInstances(ctx, client.ASG, regionIDs, r.opts.RequestTimeout)
+		if err != nil {
+			slog.Error("Failed to lookup auto scaling instances", "region", region, "error", err)
+			metricReconcileErrors.WithLabelValues(stageDescribe).Inc()
+			r.status.Failed(stageDescribe, err)
+			pass.errors++
+			describeErrs[region] = err
+			describeErr = &unavailableError{fmt.Errorf("failed to lookup auto scaling instances in %s: %v", region, err)}
+			continue
+		}
+
+		for id, group := range regionGroups {
+			groups[id] = group
+		}
+	}
+
+	// Forget about nodes which no longer exist.
+	listed := make(map[string]bool)
+
+	for _, node := range nodes {
+		listed[node.ObjectMeta.Name] = true
+	}
+
+	for name := range r.failures {
+		if !listed[name] {
+			delete(r.failures, name)
+		}
+	}
+
+	for name := range r.deleteFailures {
+		if !listed[name] {
+			delete(r.deleteFailures, name)
+		}
+	}
+
+	for name := range r.notFoundSince {
+		if !listed[name] {
+			delete(r.notFoundSince, name)
+		}
+	}
+
+	for name, deletedAt := range r.deletedAt {
+		if !listed[name] || time.Since(deletedAt) >= r.opts.DeleteCooldown {
+			delete(r.deletedAt, name)
+		}
+	}
+
+	pass.listed = len(nodes)
+
+	// Retries only look up some of the instances, and a region which
+	// couldn't be looked up would look like its instances had all gone.
+	if only == nil && describeErr == nil {
+		setNodesByState(countStates(nodes, states, r.clients))
+	}
+
+	// Healthy nodes are skipped every pass, which can drown out everything
+	// else on a large cluster.
+	skipLevel := slog.LevelInfo
+
+	if r.opts.Quiet {
+		skipLevel = slog.LevelDebug
+	}
+
+	for _, node := range nodes {
+		if only != nil && !only[node.ObjectMeta.Name] {
+			continue
+		}
+
+		// Finalizers can keep a node around for a while after it has been
+		// deleted, there is no point deleting it again.
+		if deletedAt, ok := r.deletedAt[node.ObjectMeta.Name]; ok {
+			slog.Debug("Node was recently deleted, skipping", "node", node.ObjectMeta.Name, "action", "skip", "deleted_at", deletedAt)
+			continue
+		}
+
+		metricNodesInspected.Inc()
+		pass.inspected++
+
+		id, idErr := instanceID(node)
+
+		logger := slog.With("node", node.ObjectMeta.Name, "instance_id", id)
+
+		// Some nodes (for example, not backed by EC2) never get an instance ID.
+		if idErr == errNoInstanceID && !r.opts.SkipInstanceCheck {
+			logger.Debug("Node has no instance ID, skipping", "action", "skip")
+			continue
+		}
+
+		// Without a client for its region, the instance would look like it
+		// no longer exists.
+		region, regionErr := nodeRegion(node, r.clients)
+
+		// Include the state of the instance in every decision we log, even
+		// those which don't depend on it.
+		state := stateUnknown
+
+		if r.opts.SkipInstanceCheck {
+			state = stateUnchecked
+		} else if idErr == nil && regionErr == nil && describeErrs[region] == nil {
+			state = instanceState(states, id)
+
+			if r.opts.CheckASGLifecycle && isTerminating(groups[id].lifecycleState) {
+				state = groups[id].lifecycleState
+			}
+
+			logger = logger.With("region", region)
+		}
+
+		logger = logger.With("state", state)
+
+		if r.opts.NodeNameFilter != nil && !r.opts.NodeNameFilter.MatchString(node.ObjectMeta.Name) {
+			logger.Log(ctx, skipLevel, "Node name does not match filter, skipping", "action", "skip", "filter", r.opts.NodeNameFilter.String())
+			continue
+		}
+
+		if isProtected(node, r.opts.ProtectLabels) {
+			logger.Log(ctx, skipLevel, "protected node, skipping", "action", "skip")
+			continue
+		}
+
+		if hasTaint(node, r.opts.ProtectTaints) {
+			logger.Log(ctx, skipLevel, "Node has a protected taint, skipping", "action", "skip")
+			continue
+		}
+
+		if node.ObjectMeta.Annotations[r.opts.SkipAnnotation] == "true" {
+			logger.Log(ctx, skipLevel, "Node is annotated to be skipped, skipping", "action", "skip", "annotation", r.opts.SkipAnnotation)
+			continue
+		}
+
+		// Freshly joined nodes can be not ready while the instance boots.
+		age := time.Since(node.ObjectMeta.CreationTimestamp.Time)
+
+		if age < r.opts.MinAge {
+			logger.Info("Node is too new, skipping", "action", "skip", "age", age)
+			continue
+		}
+
+		// A node which has been around this long and isn't ready is almost
+		// certainly dead, even if we can't look up its instance.
+		ancient := r.opts.NodeAgeMax > 0 && age > r.opts.NodeAgeMax
+
+		// If this instance is ready, we don't want to clean it up.
+		consider, reason := shouldConsiderForCleanup(node, r.opts.RequireConditions)
+
+		logger = logger.With("reason", reason)
+
+		if !consider {
+			// Something is badly wrong if the node claims to be ready while its
+			// instance is gone, such as a stale heartbeat or a replaced
+			// instance, but the node's word is taken over AWS's.
+			if isMismatched(state) {
+				logger.Warn("NODE IS READY BUT ITS INSTANCE IS NOT RUNNING, SKIPPING", "action", "skip")
+				metricNodeStateMismatch.Inc()
+			} else {
+				logger.Log(ctx, skipLevel, "Node is ready, skipping", "action", "skip")
+			}
+
+			pass.ready++
+			r.recovered(logger, node)
+			continue
+		}
+
+		// Give the node a chance to recover before acting on it.
+		if since := time.Since(notReadySince(node.Status.Conditions, r.opts.RequireConditions)); since < r.opts.NotReadyGrace {
+			logger.Info("Node has not been unhealthy for long, skipping", "action", "skip", "not_ready_for", since)
+			continue
+		}
+
+		// A recent heartbeat means the kubelet was alive very recently, even
+		// if we can't see its instance.
+		if since := time.Since(lastHeartbeat(node.Status.Conditions)); since < r.opts.HeartbeatGrace {
+			logger.Info("Node has posted a heartbeat recently, skipping", "action", "skip", "last_heartbeat", since)
+			continue
+		}
+
+		var (
+			svc       EC2API
+			terminate bool
+		)
+
+		// Without the instance to go on, the grace periods are all we have.
+		lookup := !r.opts.SkipInstanceCheck
+
+		// Being ancient only excuses the node from having its instance
+		// looked up, every other check still applies.
+		if lookup && idErr != nil {
+			if !ancient {
+				logger.Error("Failed to determine instance ID, skipping", "action", "skip", "error", idErr)
+				pass.errors++
+				continue
+			}
+
+			logger.Error("FAILED TO DETERMINE INSTANCE ID OF ANCIENT NODE, NOT CHECKING ITS INSTANCE", "age", age, "error", idErr)
+			lookup = false
+		}
+
+		// Likewise when AWS couldn't tell us about any of the instances in
+		// the node's region this pass.
+		if lookup && regionErr == nil && describeErrs[region] != nil {
+			if !ancient {
+				logger.Error("Failed to lookup instance state, skipping", "action", "skip", "error", describeErrs[region])
+				pass.errored[node.ObjectMeta.Name] = true
+				continue
+			}
+
+			logger.Error("FAILED TO LOOKUP INSTANCE STATE OF ANCIENT NODE, NOT CHECKING ITS INSTANCE", "age", age, "error", describeErrs[region])
+			lookup = false
+		}
+
+		if lookup {
+			// Nodes in a region we have no client for could be alive and well,
+			// however old they are.
+			if regionErr != nil {
+				logger.Warn("Cannot look up instance for node, skipping", "action", "skip", "error", regionErr)
+				continue
+			}
+
+			svc = r.clients[region].EC2
+
+			// We don't want to clean up any running instances.
+			if state == ec2.InstanceStateNameRunning {
+				logger.Log(ctx, skipLevel, "Node is running, skipping", "action", "skip")
+				pass.running++
+				r.recovered(logger, node)
+				continue
+			}
+
+			// Let an instance finish shutting down (or starting up) on its own
+			// before touching its node.
+			if r.opts.SkipTransitional && isTransitional(state) {
+				logger.Log(ctx, skipLevel, "Instance is changing state, skipping", "action", "skip")
+				r.recovered(logger, node)
+				continue
+			}
+
+			// Stopped instances (for example) may well come back, unless we have
+			// been asked to get rid of them.
+			terminate = r.opts.TerminateStopped && state == ec2.InstanceStateNameStopped
+
+			if !terminate && !isTerminating(state) && !isDeletable(state, r.opts.DeletableStates) {
+				logger.Log(ctx, skipLevel, "Instance is not in a deletable state, skipping", "action", "skip")
+				r.recovered(logger, node)
+				continue
+			}
+
+			// An instance which has only just gone missing may reappear once
+			// EC2 catches up, so it has to stay missing for a while.
+			if state != stateNotFound {
+				delete(r.notFoundSince, node.ObjectMeta.Name)
+			} else if r.opts.NotFoundGrace > 0 {
+				since, ok := r.notFoundSince[node.ObjectMeta.Name]
+				if !ok {
+					since = time.Now()
+					r.notFoundSince[node.ObjectMeta.Name] = since
+				}
+
+				if missing := time.Since(since); missing < r.opts.NotFoundGrace {
+					logger.Info("Instance has not been missing for long, skipping", "action", "skip", "not_found_for", missing)
+					continue
+				}
+			}
+		}
+
+		// Wait until the node has failed enough consecutive passes, so a brief
+		// hiccup doesn't get it deleted. Retries don't count as another pass.
+		if only == nil {
+			r.failures[node.ObjectMeta.Name]++
+		}
+
+		if r.failures[node.ObjectMeta.Name] < r.opts.Confirmations {
+			logger.Info("Node has not failed enough checks, skipping", "action", "skip", "failures", r.failures[node.ObjectMeta.Name], "confirmations", r.opts.Confirmations)
+			continue
+		}
+
+		if lookup {
+			// Make sure the instance really belongs to this cluster, in case we
+			// are looking in the wrong region or another cluster's account.
+			missing, err := r.missingTag(ctx, svc, id)
+			if err != nil && ancient {
+				logger.Error("FAILED TO CHECK INSTANCE TAGS OF ANCIENT NODE, DELETING IT ANYWAY", "action", "delete", "age", age, "error", err)
+			} else if err != nil {
+				logger.Error("Failed to check instance tags, skipping", "action", "skip", "error", err)
+				pass.nodeError(node.ObjectMeta.Name)
+				continue
+			} else if missing != "" {
+				logger.Warn("Instance does not have the required tag, skipping", "action", "skip", "tag", missing)
+				continue
+			}
+
+			// Operators who protected the instance in AWS want it kept.
+			if r.opts.RespectProtection {
+				if groups[id].protectedFromScaleIn {
+					logger.Info("Instance is protected from scale in, skipping", "action", "skip")
+					continue
+				}
+
+				protected, err := hasTerminationProtection(ctx, svc, id, r.opts.RequestTimeout)
+				if err != nil && ancient {
+					logger.Error("FAILED TO CHECK TERMINATION PROTECTION OF ANCIENT NODE, DELETING IT ANYWAY", "action", "delete", "age", age, "error", err)
+				} else if err != nil {
+					logger.Error("Failed to check instance termination protection, skipping", "action", "skip", "error", err)
+					pass.nodeError(node.ObjectMeta.Name)
+					continue
+				}
+
+				if protected {
+					logger.Info("Instance has termination protection, skipping", "action", "skip")
+					continue
+				}
+			}
+		}
+
+		// Workloads still scheduled here suggest the node isn't really dead.
+		if r.opts.RequireEmpty {
+			pods, err := workloadPods(r.clientset, node.ObjectMeta.Name)
+			if err != nil {
+				logger.Error("Failed to list pods on node, skipping", "action", "skip", "error", err)
+				pass.nodeError(node.ObjectMeta.Name)
+				continue
+			}
+
+			if len(pods) > 0 {
+				logger.Warn("Node still has pods scheduled, skipping", "action", "skip", "pods", len(pods))
+				continue
+			}
+		}
+
+		// Unlike the confirmations, the wait is recorded on the node itself,
+		// so it survives restarts and is shared by passes run with --once.
+		if r.opts.AnnotateThenWait {
+			since, pending := pendingDeleteSince(node)
+
+			if !pending && r.opts.DryRun {
+				logger.Info("Node would have been annotated as pending deletion, skipping", "action", "dry-run")
+				continue
+			}
+
+			if !pending {
+				err := markPendingDelete(r.clientset, node.ObjectMeta.Name, time.Now())
+				if err != nil {
+					logger.Error("Failed to annotate node as pending deletion, skipping", "action", "skip", "error", err)
+					pass.nodeError(node.ObjectMeta.Name)
+					continue
+				}
+
+				logger.Info("Annotated node as pending deletion, skipping", "action", "annotate", "pending_delete_wait", r.opts.PendingDeleteWait)
+				continue
+			}
+
+			if waited := time.Since(since); waited < r.opts.PendingDeleteWait {
+				logger.Info("Node has not been pending deletion for long, skipping", "action", "skip", "pending_for", waited)
+				continue
+			}
+		}
+
+		if r.opts.DryRun {
+			logger.Info("Node would have been deleted, skipping", "action", "dry-run", "terminate", terminate)
+		}
+
+		pass.candidates = append(pass.candidates, candidate{node: node, instanceID: id, region: region, state: state, terminate: terminate})
+	}
+
+	// Refuse to act at all if an unusually large share of the cluster looks dead,
+	// that is more likely to be an AWS or apiserver problem than real failures.
+	if r.opts.MaxDeletionFraction > 0 && float64(len(pass.candidates)) > r.opts.MaxDeletionFraction*float64(len(nodes)) {
+		err := fmt.Errorf("%d of %d nodes are candidates for deletion, more than the maximum fraction of %v", len(pass.candidates), len(nodes), r.opts.MaxDeletionFraction)
+
+		slog.Error("TOO MANY NODES ARE CANDIDATES FOR DELETION, NOT DELETING ANY", "candidates", len(pass.candidates), "listed", len(nodes), "max_deletion_fraction", r.opts.MaxDeletionFraction)
+		metricReconcileErrors.WithLabelValues(stageSafety).Inc()
+		r.status.Failed(stageSafety, err)
+		pass.errors++
+		r.health.Progressed()
+		return err
+	}
+
+	// Circuit breaker, in case something has made every node look dead.
+	if r.opts.MaxDeletions > 0 && len(pass.candidates) > r.opts.MaxDeletions {
+		for _, c := range pass.candidates[r.opts.MaxDeletions:] {
+			slog.Warn("Maximum deletions per pass reached, skipping until next pass", "node", c.node.ObjectMeta.Name, "instance_id", c.instanceID, "action", "skip")
+		}
+
+		slog.Warn("MAXIMUM DELETIONS PER PASS REACHED", "max_deletions", r.opts.MaxDeletions, "candidates", len(pass.candidates))
+
+		pass.candidates = pass.candidates[:r.opts.MaxDeletions]
+	}
+
+	// Unlike the cap, the rate spans passes, so a sustained scale down is
+	// spread out for whatever watches the nodes go. Nodes over the rate still
+	// qualify next pass.
+	if r.deleteLimit != nil && !r.opts.DryRun && !r.opts.CordonOnly {
+		allowed := r.deleteLimit.Take(len(pass.candidates), time.Now())
+
+		if allowed < len(pass.candidates) {
+			for _, c := range pass.candidates[allowed:] {
+				slog.Warn("Deletion rate reached, skipping until next pass", "node", c.node.ObjectMeta.Name, "instance_id", c.instanceID, "action", "skip")
+			}
+
+			slog.Warn("DELETION RATE REACHED", "delete_rate", r.opts.DeleteRate, "candidates", len(pass.candidates), "allowed", allowed)
+
+			pass.candidates = pass.candidates[:allowed]
+		}
+	}
+
+	// Written before deleting anything, so the report stands even if the
+	// deletions are interrupted.
+	if r.opts.ReportFile != "" {
+		err := writeReport(r.opts.ReportFile, pass.candidates)
+		if err != nil {
+			slog.Error("Failed to write report", "path", r.opts.ReportFile, "error", err)
+			metricReconcileErrors.WithLabelValues(stageReport).Inc()
+			r.status.Failed(stageReport, err)
+		}
+	}
+
+	var (
+		mu     sync.Mutex
+		failed int
+	)
+
+	if !r.opts.DryRun && r.opts.CordonOnly {
+		parallel(len(pass.candidates), r.opts.Concurrency, func(i int) {
+			if ctx.Err() != nil {
+				return
+			}
+
+			c := pass.candidates[i]
+
+			cordoned, err := r.markCandidate(ctx, c)
+			r.health.Progressed()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				failed++
+				pass.nodeError(c.node.ObjectMeta.Name)
+				return
+			}
+
+			if cordoned {
+				pass.cordoned++
+			}
+		})
+	} else if !r.opts.DryRun {
+		// Draining and deleting nodes can be slow, so work through them in parallel.
+		parallel(len(pass.candidates), r.opts.Concurrency, func(i int) {
+			// Skip the rest of the batch if we have been asked to shut down.
+			if ctx.Err() != nil {
+				return
+			}
+
+			c := pass.candidates[i]
+
+			// Each node can take a while to drain, so they count as progress
+			// on their own, however the node went.
+			err := r.deleteNode(ctx, c)
+			r.health.Progressed()
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				failed++
+				pass.nodeError(c.node.ObjectMeta.Name)
+
+				// The same error every pass is easy to miss, so make some noise
+				// about nodes which never seem to go away.
+				r.deleteFailures[c.node.ObjectMeta.Name]++
+
+				if r.opts.MaxDeleteFailures > 0 && r.deleteFailures[c.node.ObjectMeta.Name] >= r.opts.MaxDeleteFailures {
+					slog.Error("NODE HAS REPEATEDLY FAILED TO DELETE, IT MAY BE STUCK", "node", c.node.ObjectMeta.Name, "instance_id", c.instanceID, "failures", r.deleteFailures[c.node.ObjectMeta.Name], "error", err)
+					metricStuckDeletions.Inc()
+				}
+
+				return
+			}
+
+			pass.deleted++
+			pass.deletedNodes = append(pass.deletedNodes, c.node.ObjectMeta.Name)
+
+			delete(r.failures, c.node.ObjectMeta.Name)
+			delete(r.deleteFailures, c.node.ObjectMeta.Name)
+			delete(r.notFoundSince, c.node.ObjectMeta.Name)
+
+			if r.opts.DeleteCooldown > 0 {
+				r.deletedAt[c.node.ObjectMeta.Name] = time.Now()
+			}
+		})
+
+		// Only nodes which were actually deleted count towards the rate,
+		// the rest can have another go next pass.
+		if r.deleteLimit != nil {
+			r.deleteLimit.Return(len(pass.candidates) - pass.deleted)
+		}
+	}
+
+	if r.opts.SummarizeDeletions && pass.deleted > 0 {
+		pass.LogDeleted()
+	}
+
+	if describeErr == nil {
+		metricLastReconcile.Set(float64(time.Now().Unix()))
+		r.health.Succeeded()
+		r.pusher.Succeeded(time.Now())
+	}
+
+	if r.opts.DryRun {
+		for _, c := range pass.candidates {
+			r.audit.Decided(c.node.ObjectMeta.Name, c.instanceID, c.state, deletionReason(c.state), auditDryRun, nil, time.Now())
+		}
+
+		pass.LogDryRun()
+	}
+
+	if describeErr != nil {
+		return describeErr
+	}
+
+	if failed > 0 && r.opts.CordonOnly {
+		return &partialError{fmt.Errorf("failed to cordon %d nodes", failed)}
+	}
+
+	if failed > 0 {
+		return &partialError{fmt.Errorf("failed to delete %d nodes", failed)}
+	}
+
+	return nil
+}
+
+// Helper function to forget that a node failed any checks, now that it no
+// longer qualifies for deletion, including a pending deletion recorded on it.
+func (r *Reconciler) recovered(logger *slog.Logger, node v1.Node) {
+	delete(r.failures, node.ObjectMeta.Name)
+	delete(r.notFoundSince, node.ObjectMeta.Name)
+
+	if _, ok := node.ObjectMeta.Annotations[AnnotationPendingDelete]; !ok || r.opts.DryRun {
+		return
+	}
+
+	err := unmarkPendingDelete(r.clientset, node.ObjectMeta.Name)
+	if err != nil {
+		logger.Warn("Failed to remove pending deletion annotation from node", "action", "unannotate", "error", err)
+		return
+	}
+
+	logger.Info("Node has recovered, removed pending deletion annotation", "action", "unannotate")
+}
+
+// Helper function to find the first tag an instance must carry, as key=value,
+// which it doesn't. Instances which AWS no longer knows about can't be
+// checked, so they are treated as tagged.
+func (r *Reconciler) missingTag(ctx context.Context, svc EC2API, id string) (string, error) {
+	type tag struct {
+		key, value string
+	}
+
+	var required []tag
+
+	if r.opts.RequireTagKey != "" {
+		required = append(required, tag{r.opts.RequireTagKey, r.opts.RequireTagValue})
+	}
+
+	if r.opts.ClusterName != "" {
+		required = append(required, tag{clusterTagPrefix + r.opts.ClusterName, clusterTagOwned})
+	}
+
+	for _, t := range required {
+		tagged, err := hasTag(ctx, svc, id, t.key, t.value, r.opts.RequestTimeout)
+		if err != nil {
+			return "", err
+		}
+
+		if !tagged {
+			return t.key + "=" + t.value, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Helper function to drain (if enabled) and delete a node. Errors are logged
+// and counted here.
+func (r *Reconciler) deleteNode(ctx context.Context, c candidate) (err error) {
+	logger := slog.With("node", c.node.ObjectMeta.Name, "instance_id", c.instanceID, "state", c.state)
+
+	_, span := r.tracing.Start(ctx, "delete node", "node", c.node.ObjectMeta.Name, "instance_id", c.instanceID, "state", c.state)
+	defer func() { span.End(err) }()
+
+	// Nodes which fail to go, however far they got, are audited as well.
+	defer func() {
+		if err != nil {
+			r.audit.Decided(c.node.ObjectMeta.Name, c.instanceID, c.state, deletionReason(c.state), auditFailed, err, time.Now())
+		}
+	}()
+
+	// Run the hook before touching the node, so a failure leaves it as it was.
+	if r.opts.PreDeleteExec != "" {
+		err = runPreDelete(ctx, r.opts.PreDeleteExec, r.opts.PreDeleteTimeout, c)
+		if err != nil {
+			logger.Error("Pre-delete hook failed, not deleting node", "action", "pre-delete", "error", err)
+			metricReconcileErrors.WithLabelValues(stagePreDelete).Inc()
+			r.status.Failed(stagePreDelete, err)
+			return err
+		}
+	}
+
+	if r.opts.Drain {
+		err := drain(ctx, r.clientset, c.node, r.opts.DrainTimeout)
+
+		// Shutting down isn't a failure, but whoever looks at the node next
+		// needs to know what state it was left in.
+		var interrupted *interruptedDrainError
+
+		if errors.As(err, &interrupted) {
+			logger.Warn("Drain was interrupted, node was not deleted", "action", "drain", "cordoned", interrupted.cordoned, "pods_pending", interrupted.pending, "error", interrupted.err)
+			return err
+		}
+
+		if err == errDrainTimeout && r.opts.DrainForce {
+			logger.Warn("Timed out draining node, deleting anyway", "action", "drain")
+		} else if err != nil {
+			logger.Error("Failed to drain node", "action", "drain", "error", err)
+			metricReconcileErrors.WithLabelValues(stageDrain).Inc()
+			r.status.Failed(stageDrain, err)
+			return err
+		}
+	}
+
+	// Leaving the node behind means we will try again next pass.
+	if c.terminate {
+		err = terminateInstance(ctx, r.clients[c.region].EC2, c.instanceID, r.opts.RequestTimeout)
+		if err != nil {
+			logger.Error("Failed to terminate instance", "action", "terminate", "error", err)
+			metricReconcileErrors.WithLabelValues(stageTerminate).Inc()
+			r.status.Failed(stageTerminate, err)
+			return err
+		}
+
+		logger.Log(ctx, r.deletedLevel(), "Terminated instance", "action", "terminate")
+	}
+
+	// This is only a record, so it shouldn't stop the node being deleted.
+	err = annotateNode(r.clientset, c.node.ObjectMeta.Name, deletionReason(c.state), time.Now())
+	if err != nil {
+		logger.Warn("Failed to annotate node before deleting", "action", "annotate", "error", err)
+	}
+
+	err = deleteRetrying(ctx, r.clientset, c.node.ObjectMeta.Name, deleteOptions(r.opts.DeleteGracePeriod, r.opts.DeletePropagation), r.opts.DeleteRetries, retryBaseDelay)
+	if err != nil {
+		logger.Error("Failed to delete node", "action", "delete", "error", err)
+		metricReconcileErrors.WithLabelValues(stageDelete).Inc()
+		r.status.Failed(stageDelete, err)
+		return err
+	}
+
+	logger.Log(ctx, r.deletedLevel(), "Deleted node", "action", "delete")
+
+	r.slack.NodeDeleted(c.node.ObjectMeta.Name, c.instanceID, deletionReason(c.state))
+	r.webhook.NodeDeleted(c.node.ObjectMeta.Name, c.instanceID, c.state, deletionReason(c.state), time.Now())
+	r.audit.Decided(c.node.ObjectMeta.Name, c.instanceID, c.state, deletionReason(c.state), auditDeleted, nil, time.Now())
+
+	metricNodesDeleted.Inc()
+	observeNotReadyAge(c.node, r.opts.RequireConditions, time.Now())
+
+	r.recorder.Eventf(&c.node, v1.EventTypeNormal, eventReasonNodeCleanup, "Deleted node: %s", deletionReason(c.state))
+
+	return nil
+}
+
+// Helper function to cordon and label a candidate instead of deleting it,
+// reporting whether it needed to be. Candidates which a previous pass already
+// cordoned and labeled are left as they are. Errors are logged and counted
+// here.
+func (r *Reconciler) markCandidate(ctx context.Context, c candidate) (bool, error) {
+	logger := slog.With("node", c.node.ObjectMeta.Name, "instance_id", c.instanceID, "state", c.state)
+
+	if c.node.Spec.Unschedulable && c.node.ObjectMeta.Labels[LabelCandidate] == "true" {
+		logger.Debug("Node is already cordoned for review, skipping", "action", "skip")
+		return false, nil
+	}
+
+	_, span := r.tracing.Start(ctx, "cordon node", "node", c.node.ObjectMeta.Name, "instance_id", c.instanceID, "state", c.state)
+
+	err := cordonCandidate(r.clientset, c.node.ObjectMeta.Name)
+	span.End(err)
+
+	if err != nil {
+		logger.Error("Failed to cordon node", "action", "cordon", "error", err)
+		metricReconcileErrors.WithLabelValues(stageCordon).Inc()
+		r.status.Failed(stageCordon, err)
+		r.audit.Decided(c.node.ObjectMeta.Name, c.instanceID, c.state, deletionReason(c.state), auditFailed, err, time.Now())
+		return false, err
+	}
+
+	logger.Info("Cordoned node for review, not deleting it", "action", "cordon", "reason", deletionReason(c.state))
+
+	r.recorder.Eventf(&c.node, v1.EventTypeNormal, eventReasonNodeCleanup, "Cordoned node for review: %s", deletionReason(c.state))
+	r.audit.Decided(c.node.ObjectMeta.Name, c.instanceID, c.state, deletionReason(c.state), auditCordoned, nil, time.Now())
+
+	return true, nil
+}
+
+// Helper function to work out the level to log each deletion at. When they
+// are summarized once per pass, the details are only needed for debugging.
+func (r *Reconciler) deletedLevel() slog.Level {
+	if r.opts.SummarizeDeletions {
+		return slog.LevelDebug
+	}
+
+	return slog.LevelInfo
+}
+
+// Helper function to build the options nodes are deleted with.
+func deleteOptions(gracePeriod *int64, propagation metav1.DeletionPropagation) *metav1.DeleteOptions {
+	opts := &metav1.DeleteOptions{
+		GracePeriodSeconds: gracePeriod,
+	}
+
+	if propagation != "" {
+		opts.PropagationPolicy = &propagation
+	}
+
+	return opts
+}
+
+// Helper function to work out how long to wait until the next pass. The
+// interval doubles, up to max, while the APIs we depend on are unavailable and
+// goes back to the base frequency after a pass which reached them.
+func nextInterval(current, base, max time.Duration, unavailable bool) time.Duration {
+	if !unavailable || max <= base {
+		return base
+	}
+
+	next := current * 2
+	if next > max {
+		next = max
+	}
+
+	return next
+}
+
+// Helper function to randomly adjust an interval by up to ±jitter (as a
+// fraction), so loops across many clusters don't synchronise.
+func jittered(interval time.Duration, jitter float64) time.Duration {
+	return interval + time.Duration((rand.Float64()*2-1)*jitter*float64(interval))
+}
+
+// Helper function to call fn for each index up to n, running at most limit
+// calls at a time, and wait for them all to finish. A limit below 1 runs the
+// calls one at a time, rather than none at all.
+func parallel(n, limit int, fn func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, limit)
+	)
+
+	for i := 0; i < n; i++ {
+		semaphore <- struct{}{}
+		wg.Add(1)
+
+		go func(i int) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
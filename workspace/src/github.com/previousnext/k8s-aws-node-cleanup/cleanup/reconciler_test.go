@@ -0,0 +1,1586 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+// Options matching the flag defaults, except nodes are deleted on the first
+// failed pass.
+func testOptions() Options {
+	return Options{
+		Frequency:       2 * time.Minute,
+		SkipAnnotation:  "k8s-aws-cleanup/skip",
+		MinAge:          5 * time.Minute,
+		DeletableStates: []string{ec2.InstanceStateNameTerminated, ec2.InstanceStateNameShuttingDown},
+		Confirmations:   1,
+		Concurrency:     5,
+		RequestTimeout:  30 * time.Second,
+		DrainTimeout:    5 * time.Minute,
+	}
+}
+
+// Helper function to build a Reconciler for tests, failing the test if the
+// options are invalid.
+func newTestReconciler(t *testing.T, clients map[string]RegionClient, clientset kubernetes.Interface, opts Options) *Reconciler {
+	r, err := New(clients, clientset, record.NewFakeRecorder(100), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// Helper function to collect the events a test Reconciler has recorded so far.
+func recordedEvents(r *Reconciler) []string {
+	var events []string
+
+	for {
+		select {
+		case event := <-r.recorder.(*record.FakeRecorder).Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// Helper function to build a node backed by an instance, with the given Ready status.
+func testNode(name, id string, ready v1.ConditionStatus) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{ExternalID: id},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+		},
+	}
+}
+
+// Helper function to list the names of the nodes left in the cluster.
+func remainingNodes(t *testing.T, clientset *fake.Clientset) []string {
+	list, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	assert.Nil(t, err)
+
+	var names []string
+
+	for _, node := range list.Items {
+		names = append(names, node.ObjectMeta.Name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestReconcile(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("ready", "i-ready", v1.ConditionTrue),
+		testNode("not-ready-running", "i-running", v1.ConditionFalse),
+		testNode("not-ready-stopped", "i-stopped", v1.ConditionFalse),
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+		testNode("unknown-terminated", "i-terminated2", v1.ConditionUnknown),
+		testNode("not-ready-not-found", "i-gone", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-ready":       ec2.InstanceStateNameRunning,
+					"i-running":     ec2.InstanceStateNameRunning,
+					"i-stopped":     ec2.InstanceStateNameStopped,
+					"i-terminated":  ec2.InstanceStateNameTerminated,
+					"i-terminated2": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	r := newTestReconciler(t, clients, clientset, testOptions())
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"not-ready-running", "not-ready-stopped", "ready"}, remainingNodes(t, clientset))
+}
+
+func TestReconcileOnce(t *testing.T) {
+	unparseable := testNode("not-ready-unparseable", "", v1.ConditionFalse)
+	unparseable.Spec.ProviderID = "aws:///ap-southeast-2a/"
+
+	clientset := fake.NewSimpleClientset(
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+		unparseable,
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-terminated": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	r := newTestReconciler(t, clients, clientset, testOptions())
+
+	// The pass itself succeeds, but a CronJob should hear about the node
+	// which couldn't be inspected.
+	err := r.ReconcileOnce(context.Background())
+	assert.True(t, IsPartial(err), err)
+	assert.Equal(t, "failed to inspect 1 nodes", err.Error())
+
+	assert.Equal(t, []string{"not-ready-unparseable"}, remainingNodes(t, clientset))
+
+	err = r.ReconcileOnce(context.Background())
+	assert.True(t, IsPartial(err), err)
+
+	clientset = fake.NewSimpleClientset(testNode("ready", "i-ready", v1.ConditionTrue))
+
+	clients["ap-southeast-2"].EC2.(*fakeEC2).instances["i-ready"] = ec2.InstanceStateNameRunning
+
+	err = newTestReconciler(t, clients, clientset, testOptions()).ReconcileOnce(context.Background())
+	assert.Nil(t, err)
+}
+
+func TestReconcileLogsState(t *testing.T) {
+	var buf bytes.Buffer
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	clientset := fake.NewSimpleClientset(
+		testNode("ready", "i-ready", v1.ConditionTrue),
+		testNode("not-ready-running", "i-running", v1.ConditionFalse),
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-ready":      ec2.InstanceStateNameRunning,
+					"i-running":    ec2.InstanceStateNameRunning,
+					"i-terminated": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	r := newTestReconciler(t, clients, clientset, testOptions())
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+
+	states := make(map[string]string)
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+
+		err := json.Unmarshal([]byte(line), &entry)
+		assert.Nil(t, err)
+
+		if node, ok := entry["node"].(string); ok {
+			states[node+" "+entry["msg"].(string)] = entry["state"].(string)
+		}
+	}
+
+	assert.Equal(t, map[string]string{
+		"ready Node is ready, skipping":               ec2.InstanceStateNameRunning,
+		"not-ready-running Node is running, skipping": ec2.InstanceStateNameRunning,
+		"not-ready-terminated Deleted node":           ec2.InstanceStateNameTerminated,
+	}, states)
+}
+
+func TestReconcileQuiet(t *testing.T) {
+	var buf bytes.Buffer
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	clientset := fake.NewSimpleClientset(
+		testNode("ready", "i-ready", v1.ConditionTrue),
+		testNode("not-ready-running", "i-running", v1.ConditionFalse),
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-ready":      ec2.InstanceStateNameRunning,
+					"i-running":    ec2.InstanceStateNameRunning,
+					"i-terminated": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.Quiet = true
+
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+
+	// Only the deletion is worth logging about a node.
+	var messages []string
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+
+		err := json.Unmarshal([]byte(line), &entry)
+		assert.Nil(t, err)
+
+		if node, ok := entry["node"].(string); ok {
+			messages = append(messages, node+" "+entry["msg"].(string))
+		}
+	}
+
+	assert.Equal(t, []string{"not-ready-terminated Deleted node"}, messages)
+}
+
+func TestReconcileSummarizeDeletions(t *testing.T) {
+	var buf bytes.Buffer
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	clientset := fake.NewSimpleClientset(
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+		testNode("not-ready-not-found", "i-gone", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.SummarizeDeletions = true
+
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, remainingNodes(t, clientset))
+
+	var deleted []map[string]interface{}
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+
+		err := json.Unmarshal([]byte(line), &entry)
+		assert.Nil(t, err)
+
+		assert.NotEqual(t, "Deleted node", entry["msg"])
+
+		if entry["msg"] == "Deleted nodes" {
+			deleted = append(deleted, entry)
+		}
+	}
+
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, float64(2), deleted[0]["count"])
+	assert.Equal(t, []interface{}{"not-ready-not-found", "not-ready-terminated"}, deleted[0]["nodes"])
+}
+
+func TestReconcileDryRun(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+		testNode("not-ready-not-found", "i-gone", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.DryRun = true
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"not-ready-not-found", "not-ready-terminated"}, remainingNodes(t, clientset))
+}
+
+func TestReconcileConfirmations(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse))
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.Confirmations = 2
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	// The first failed pass only counts against the node.
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"not-ready-terminated"}, remainingNodes(t, clientset))
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, remainingNodes(t, clientset))
+}
+
+func TestReconcileTerminateStopped(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{"i-stopped": ec2.InstanceStateNameStopped},
+	}
+
+	clients := map[string]RegionClient{"ap-southeast-2": {EC2: svc}}
+
+	// Stopped instances are left alone by default.
+	clientset := fake.NewSimpleClientset(testNode("not-ready-stopped", "i-stopped", v1.ConditionFalse))
+
+	err := newTestReconciler(t, clients, clientset, testOptions()).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"not-ready-stopped"}, remainingNodes(t, clientset))
+	assert.Equal(t, ec2.InstanceStateNameStopped, svc.instances["i-stopped"])
+
+	opts := testOptions()
+	opts.TerminateStopped = true
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, remainingNodes(t, clientset))
+	assert.Equal(t, ec2.InstanceStateNameShuttingDown, svc.instances["i-stopped"])
+	assert.Equal(t, []string{"Normal NodeCleanup Deleted node: node is not ready and its instance is stopped"}, recordedEvents(r))
+}
+
+func TestReconcileGuards(t *testing.T) {
+	recently := metav1.NewTime(time.Now().Add(-time.Minute))
+
+	tests := []struct {
+		name     string
+		node     func(node *v1.Node)
+		state    string
+		opts     func(opts *Options)
+		svc      func(svc *fakeEC2)
+		asg      *fakeAutoscaling
+		survives bool
+	}{
+		{
+			name:  "terminated",
+			state: ec2.InstanceStateNameTerminated,
+		},
+		{
+			name:     "termination protection",
+			state:    ec2.InstanceStateNameTerminated,
+			opts:     func(opts *Options) { opts.RespectProtection = true },
+			svc:      func(svc *fakeEC2) { svc.protected = map[string]bool{"i-123": true} },
+			survives: true,
+		},
+		{
+			name:     "scale in protection",
+			state:    ec2.InstanceStateNameTerminated,
+			opts:     func(opts *Options) { opts.RespectProtection = true },
+			asg:      &fakeAutoscaling{states: map[string]string{"i-123": "InService"}, protected: map[string]bool{"i-123": true}},
+			survives: true,
+		},
+		{
+			name:  "auto scaling group terminating",
+			state: ec2.InstanceStateNameRunning,
+			opts:  func(opts *Options) { opts.CheckASGLifecycle = true },
+			asg:   &fakeAutoscaling{states: map[string]string{"i-123": "Terminating:Wait"}},
+		},
+		{
+			name:     "auto scaling group terminating unchecked",
+			state:    ec2.InstanceStateNameRunning,
+			asg:      &fakeAutoscaling{states: map[string]string{"i-123": "Terminating:Wait"}},
+			survives: true,
+		},
+		{
+			name:     "recent heartbeat",
+			state:    ec2.InstanceStateNameTerminated,
+			node:     func(node *v1.Node) { node.Status.Conditions[0].LastHeartbeatTime = recently },
+			opts:     func(opts *Options) { opts.HeartbeatGrace = 10 * time.Minute },
+			survives: true,
+		},
+		{
+			name:     "control plane",
+			state:    ec2.InstanceStateNameTerminated,
+			node:     func(node *v1.Node) { node.ObjectMeta.Labels = map[string]string{labelRoleControlPlane: ""} },
+			survives: true,
+		},
+		{
+			name:     "protected label",
+			state:    ec2.InstanceStateNameTerminated,
+			node:     func(node *v1.Node) { node.ObjectMeta.Labels = map[string]string{"pool": "infra"} },
+			opts:     func(opts *Options) { opts.ProtectLabels = []string{"pool=infra"} },
+			survives: true,
+		},
+		{
+			name:  "other label",
+			state: ec2.InstanceStateNameTerminated,
+			node:  func(node *v1.Node) { node.ObjectMeta.Labels = map[string]string{"pool": "workers"} },
+			opts:  func(opts *Options) { opts.ProtectLabels = []string{"pool=infra"} },
+		},
+		{
+			name:  "protected taint",
+			state: ec2.InstanceStateNameTerminated,
+			node: func(node *v1.Node) {
+				node.Spec.Taints = []v1.Taint{{Key: "dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule}}
+			},
+			opts: func(opts *Options) {
+				opts.ProtectTaints = []TaintSpec{{Key: "dedicated", Value: "gpu", HasValue: true}}
+			},
+			survives: true,
+		},
+		{
+			name:     "filtered out",
+			state:    ec2.InstanceStateNameTerminated,
+			opts:     func(opts *Options) { opts.NodeNameFilter = regexp.MustCompile("^worker-") },
+			survives: true,
+		},
+		{
+			name:     "untagged",
+			state:    ec2.InstanceStateNameTerminated,
+			opts:     func(opts *Options) { opts.RequireTagKey, opts.RequireTagValue = "cluster", "prod" },
+			survives: true,
+		},
+		{
+			name:  "tagged",
+			state: ec2.InstanceStateNameTerminated,
+			opts:  func(opts *Options) { opts.RequireTagKey, opts.RequireTagValue = "cluster", "prod" },
+			svc:   func(svc *fakeEC2) { svc.tags = map[string]map[string]string{"i-123": {"cluster": "prod"}} },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := testNode("not-ready", "i-123", v1.ConditionFalse)
+			if test.node != nil {
+				test.node(node)
+			}
+
+			clientset := fake.NewSimpleClientset(node)
+
+			svc := &fakeEC2{instances: map[string]string{"i-123": test.state}}
+			if test.svc != nil {
+				test.svc(svc)
+			}
+
+			client := RegionClient{EC2: svc}
+			if test.asg != nil {
+				client.ASG = test.asg
+			}
+
+			opts := testOptions()
+			if test.opts != nil {
+				test.opts(&opts)
+			}
+
+			err := newTestReconciler(t, map[string]RegionClient{"ap-southeast-2": client}, clientset, opts).Reconcile(context.Background())
+			assert.Nil(t, err)
+
+			if test.survives {
+				assert.Equal(t, []string{"not-ready"}, remainingNodes(t, clientset))
+			} else {
+				assert.Empty(t, remainingNodes(t, clientset))
+			}
+		})
+	}
+}
+
+func TestReconcileSkipTransitional(t *testing.T) {
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-shutting-down": ec2.InstanceStateNameShuttingDown,
+			"i-terminated":    ec2.InstanceStateNameTerminated,
+		},
+	}
+
+	clients := map[string]RegionClient{"ap-southeast-2": {EC2: svc}}
+
+	clientset := fake.NewSimpleClientset(
+		testNode("not-ready-shutting-down", "i-shutting-down", v1.ConditionFalse),
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+		testNode("not-ready-gone", "i-gone", v1.ConditionFalse),
+	)
+
+	opts := testOptions()
+	opts.SkipTransitional = true
+
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"not-ready-shutting-down"}, remainingNodes(t, clientset))
+
+	// Once the instance has finished shutting down, its node goes too.
+	svc.instances["i-shutting-down"] = ec2.InstanceStateNameTerminated
+
+	err = newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, remainingNodes(t, clientset))
+}
+
+func TestReconcileSkipInstanceCheck(t *testing.T) {
+	longAgo := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	recently := metav1.NewTime(time.Now().Add(-time.Minute))
+
+	// Not backed by EC2 at all.
+	dead := testNode("not-ready-long", "", v1.ConditionFalse)
+	dead.Status.Conditions[0].LastTransitionTime = longAgo
+
+	recovering := testNode("not-ready-recently", "", v1.ConditionFalse)
+	recovering.Status.Conditions[0].LastTransitionTime = recently
+
+	clientset := fake.NewSimpleClientset(dead, recovering, testNode("ready", "", v1.ConditionTrue))
+
+	opts := testOptions()
+	opts.SkipInstanceCheck = true
+	opts.NotReadyGrace = time.Hour
+
+	r := newTestReconciler(t, map[string]RegionClient{}, clientset, opts)
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"not-ready-recently", "ready"}, remainingNodes(t, clientset))
+	assert.Equal(t, []CandidateReport{{Node: "not-ready-long", State: stateUnchecked}}, r.last.Report(false, nil).Candidates)
+	assert.Equal(t, []string{"Normal NodeCleanup Deleted node: node has not been ready for longer than the grace period"}, recordedEvents(r))
+}
+
+func TestReconcileRequireEmpty(t *testing.T) {
+	deleted := metav1.Now()
+
+	clientset := fake.NewSimpleClientset(
+		testNode("not-ready-busy", "i-busy", v1.ConditionFalse),
+		testNode("not-ready-empty", "i-empty", v1.ConditionFalse),
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       v1.PodSpec{NodeName: "not-ready-busy"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "fluentd",
+				Namespace:       "kube-system",
+				OwnerReferences: []metav1.OwnerReference{{Kind: "DaemonSet", Name: "fluentd"}},
+			},
+			Spec:   v1.PodSpec{NodeName: "not-ready-empty"},
+			Status: v1.PodStatus{Phase: v1.PodRunning},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "stuck", Namespace: "default", DeletionTimestamp: &deleted},
+			Spec:       v1.PodSpec{NodeName: "not-ready-empty"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		},
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-busy":  ec2.InstanceStateNameTerminated,
+					"i-empty": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.RequireEmpty = true
+
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"not-ready-busy"}, remainingNodes(t, clientset))
+}
+
+func TestReconcileClusterName(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("not-ready-owned", "i-owned", v1.ConditionFalse),
+		testNode("not-ready-other-cluster", "i-other", v1.ConditionFalse),
+		testNode("not-ready-untagged", "i-untagged", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-owned":    ec2.InstanceStateNameTerminated,
+					"i-other":    ec2.InstanceStateNameTerminated,
+					"i-untagged": ec2.InstanceStateNameTerminated,
+				},
+				tags: map[string]map[string]string{
+					"i-owned": {"kubernetes.io/cluster/prod": "owned"},
+					"i-other": {"kubernetes.io/cluster/staging": "owned"},
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.ClusterName = "prod"
+
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"not-ready-other-cluster", "not-ready-untagged"}, remainingNodes(t, clientset))
+}
+
+func TestReconcileInstanceTagFilter(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("not-ready-running", "i-running", v1.ConditionFalse),
+		testNode("not-ready-other-cluster", "i-other", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-running": ec2.InstanceStateNameRunning,
+					"i-other":   ec2.InstanceStateNameRunning,
+				},
+				tags: map[string]map[string]string{
+					"i-running": {"cluster": "prod"},
+					"i-other":   {"cluster": "staging"},
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.InstanceTagKey = "cluster"
+	opts.InstanceTagValue = "prod"
+
+	// Instances without the tag are treated as gone.
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"not-ready-running"}, remainingNodes(t, clientset))
+}
+
+func TestReconcileNodeAgeMax(t *testing.T) {
+	// Neither node's instance can be looked up.
+	ancient := testNode("ancient", "", v1.ConditionFalse)
+	ancient.Spec.ProviderID = "aws:///us-east-1a/"
+
+	recent := testNode("recent", "", v1.ConditionFalse)
+	recent.Spec.ProviderID = "aws:///us-east-1a/"
+	recent.ObjectMeta.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+
+	// However old, nodes in a region we have no client for may be fine.
+	elsewhere := testNode("ancient-elsewhere", "", v1.ConditionFalse)
+	elsewhere.Spec.ProviderID = "aws:///us-east-1a/i-elsewhere"
+
+	clientset := fake.NewSimpleClientset(ancient, recent, elsewhere)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {EC2: &fakeEC2{instances: map[string]string{}}},
+	}
+
+	err := newTestReconciler(t, clients, clientset, testOptions()).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ancient", "ancient-elsewhere", "recent"}, remainingNodes(t, clientset))
+
+	opts := testOptions()
+	opts.NodeAgeMax = 24 * time.Hour
+	opts.Confirmations = 2
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	// Ancient nodes still have to fail enough passes.
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ancient", "ancient-elsewhere", "recent"}, remainingNodes(t, clientset))
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ancient-elsewhere", "recent"}, remainingNodes(t, clientset))
+}
+
+func TestReconcileNodeAgeMaxDryRun(t *testing.T) {
+	ancient := testNode("ancient", "", v1.ConditionFalse)
+	ancient.Spec.ProviderID = "aws:///us-east-1a/"
+
+	clientset := fake.NewSimpleClientset(ancient)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {EC2: &fakeEC2{instances: map[string]string{}}},
+	}
+
+	opts := testOptions()
+	opts.NodeAgeMax = 24 * time.Hour
+	opts.DryRun = true
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ancient"}, remainingNodes(t, clientset))
+	assert.Len(t, r.last.candidates, 1)
+}
+
+func TestReconcileRetry(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("terminated", "i-terminated", v1.ConditionFalse),
+		testNode("flaky", "i-flaky", v1.ConditionFalse),
+	)
+
+	// Fail the first attempt to delete one of the nodes.
+	failed := false
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		if action.(core.DeleteAction).GetName() != "flaky" || failed {
+			return false, nil, nil
+		}
+
+		failed = true
+
+		return true, nil, errors.New("etcdserver: request timed out")
+	})
+
+	svc := &fakeEC2{
+		instances: map[string]string{
+			"i-terminated": ec2.InstanceStateNameTerminated,
+			"i-flaky":      ec2.InstanceStateNameTerminated,
+			"i-late":       ec2.InstanceStateNameTerminated,
+		},
+	}
+
+	r := newTestReconciler(t, map[string]RegionClient{"ap-southeast-2": {EC2: svc}}, clientset, testOptions())
+
+	err := r.Reconcile(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"flaky"}, remainingNodes(t, clientset))
+	assert.Equal(t, map[string]bool{"flaky": true}, r.requeue)
+
+	// Retries only look at the nodes which hit an error, and their instances.
+	_, err = clientset.CoreV1().Nodes().Create(testNode("late", "i-late", v1.ConditionFalse))
+	assert.Nil(t, err)
+
+	svc.described = nil
+
+	err = r.Retry(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"late"}, remainingNodes(t, clientset))
+	assert.Equal(t, []string{"i-flaky"}, svc.described)
+	assert.Empty(t, r.requeue)
+}
+
+func TestReconcileStuckDeletion(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("stuck", "i-terminated", v1.ConditionFalse))
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("finalizer is stuck")
+	})
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.MaxDeleteFailures = 2
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	stuck := func() float64 {
+		var m dto.Metric
+		metricStuckDeletions.Write(&m)
+		return m.GetCounter().GetValue()
+	}
+
+	before := stuck()
+
+	// Only failures from the threshold onwards count as stuck.
+	for i := 0; i < 3; i++ {
+		err := r.Reconcile(context.Background())
+		assert.True(t, IsPartial(err), err)
+	}
+
+	assert.Equal(t, 3, r.deleteFailures["stuck"])
+	assert.Equal(t, before+2, stuck())
+}
+
+func TestReconcileAuditLog(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("terminated", "i-terminated", v1.ConditionFalse),
+		testNode("stuck", "i-stuck", v1.ConditionFalse),
+	)
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		if action.(core.DeleteAction).GetName() != "stuck" {
+			return false, nil, nil
+		}
+
+		return true, nil, errors.New("finalizer is stuck")
+	})
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-terminated": ec2.InstanceStateNameTerminated,
+					"i-stuck":      ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	opts := testOptions()
+	opts.Notifications.AuditLog = path
+
+	r := newTestReconciler(t, clients, clientset, opts)
+	defer r.Close()
+
+	err := r.Reconcile(context.Background())
+	assert.True(t, IsPartial(err), err)
+
+	// Deletions which fail are recorded too, along with why.
+	entries := readAudit(t, path)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Node < entries[j].Node })
+
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "stuck", entries[0].Node)
+	assert.Equal(t, auditFailed, entries[0].Outcome)
+	assert.Equal(t, "finalizer is stuck", entries[0].Error)
+	assert.Equal(t, "terminated", entries[1].Node)
+	assert.Equal(t, auditDeleted, entries[1].Outcome)
+	assert.Equal(t, "", entries[1].Error)
+}
+
+func TestReconcileDeleteCooldown(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("lingering", "i-terminated", v1.ConditionFalse))
+
+	// A finalizer keeps the node around after it has been deleted.
+	var deletes int
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		deletes++
+		return true, nil, nil
+	})
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.DeleteCooldown = time.Minute
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	for i := 0; i < 2; i++ {
+		err := r.Reconcile(context.Background())
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 1, deletes)
+	assert.Equal(t, 0, r.last.deleted)
+
+	// Once the cooldown is over, the node is deleted again.
+	r.deletedAt["lingering"] = time.Now().Add(-time.Hour)
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deletes)
+}
+
+func TestReconcileRequireConditions(t *testing.T) {
+	unreachable := testNode("unreachable", "i-terminated", v1.ConditionTrue)
+	unreachable.Status.Conditions = append(unreachable.Status.Conditions, v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue})
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+			},
+		},
+	}
+
+	// Ready is all that counts, unless other conditions are required.
+	clientset := fake.NewSimpleClientset(unreachable)
+
+	err := newTestReconciler(t, clients, clientset, testOptions()).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unreachable"}, remainingNodes(t, clientset))
+
+	opts := testOptions()
+	opts.RequireConditions = []ConditionSpec{{Type: v1.NodeNetworkUnavailable, Healthy: v1.ConditionFalse}}
+
+	err = newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, remainingNodes(t, clientset))
+}
+
+func TestReconcileNotFoundGrace(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("missing", "i-gone", v1.ConditionFalse),
+		testNode("flapping", "i-flapping", v1.ConditionFalse),
+		testNode("terminated", "i-terminated", v1.ConditionFalse),
+	)
+
+	svc := &fakeEC2{
+		instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+	}
+
+	opts := testOptions()
+	opts.NotFoundGrace = time.Minute
+
+	r := newTestReconciler(t, map[string]RegionClient{"ap-southeast-2": {EC2: svc}}, clientset, opts)
+
+	// Only instances AWS still knows about are deleted straight away.
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"flapping", "missing"}, remainingNodes(t, clientset))
+	assert.Len(t, r.notFoundSince, 2)
+
+	// An instance which turns up again has to go missing all over again.
+	svc.Lock()
+	svc.instances["i-flapping"] = ec2.InstanceStateNameRunning
+	svc.Unlock()
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.NotContains(t, r.notFoundSince, "flapping")
+
+	svc.Lock()
+	delete(svc.instances, "i-flapping")
+	svc.Unlock()
+
+	r.notFoundSince["missing"] = time.Now().Add(-time.Hour)
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"flapping"}, remainingNodes(t, clientset))
+	assert.NotContains(t, r.notFoundSince, "missing")
+	assert.Contains(t, r.notFoundSince, "flapping")
+}
+
+func TestReconcileDeleteRate(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("terminated1", "i-terminated1", v1.ConditionFalse),
+		testNode("terminated2", "i-terminated2", v1.ConditionFalse),
+		testNode("terminated3", "i-terminated3", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-terminated1": ec2.InstanceStateNameTerminated,
+					"i-terminated2": ec2.InstanceStateNameTerminated,
+					"i-terminated3": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.DeleteRate = 2
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, r.last.deleted)
+	assert.Len(t, remainingNodes(t, clientset), 1)
+
+	// The next pass has to wait for the bucket to refill.
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, r.last.deleted)
+	assert.Len(t, remainingNodes(t, clientset), 1)
+
+	r.deleteLimit.last = r.deleteLimit.last.Add(-time.Minute)
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, r.last.deleted)
+	assert.Empty(t, remainingNodes(t, clientset))
+}
+
+func TestReconcileDeleteRateFailedDelete(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("terminated1", "i-terminated1", v1.ConditionFalse),
+		testNode("terminated2", "i-terminated2", v1.ConditionFalse),
+	)
+
+	// Fail every attempt to delete one of the nodes, until told otherwise.
+	failing := true
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		if action.(core.DeleteAction).GetName() != "terminated1" || !failing {
+			return false, nil, nil
+		}
+
+		return true, nil, errors.New("etcdserver: request timed out")
+	})
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-terminated1": ec2.InstanceStateNameTerminated,
+					"i-terminated2": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.DeleteRate = 2
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	err := r.Reconcile(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, r.last.deleted)
+	assert.Equal(t, []string{"terminated1"}, remainingNodes(t, clientset))
+
+	// The failed deletion gave its token back, so the next pass can delete
+	// the node without waiting for the bucket to refill.
+	failing = false
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, r.last.deleted)
+	assert.Empty(t, remainingNodes(t, clientset))
+}
+
+func TestReconcileAnnotateThenWait(t *testing.T) {
+	node := testNode("flapping", "i-flapping", v1.ConditionFalse)
+
+	clientset := fake.NewSimpleClientset()
+
+	// The fake clientset can't apply patches, so keep the node here and apply
+	// the annotations ourselves.
+	clientset.PrependReactor("list", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		return true, &v1.NodeList{Items: []v1.Node{*node}}, nil
+	})
+
+	clientset.PrependReactor("patch", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		var patch struct {
+			Metadata struct {
+				Annotations map[string]*string `json:"annotations"`
+			} `json:"metadata"`
+		}
+
+		err := json.Unmarshal(action.(core.PatchActionImpl).GetPatch(), &patch)
+		if err != nil {
+			return true, nil, err
+		}
+
+		annotations := make(map[string]string)
+
+		for key, value := range node.ObjectMeta.Annotations {
+			annotations[key] = value
+		}
+
+		for key, value := range patch.Metadata.Annotations {
+			if value == nil {
+				delete(annotations, key)
+			} else {
+				annotations[key] = *value
+			}
+		}
+
+		node.ObjectMeta.Annotations = annotations
+
+		return true, node, nil
+	})
+
+	var deletes int
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		deletes++
+		return true, nil, nil
+	})
+
+	instances := map[string]string{"i-flapping": ec2.InstanceStateNameTerminated}
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{instances: instances},
+		},
+	}
+
+	opts := testOptions()
+	opts.AnnotateThenWait = true
+	opts.PendingDeleteWait = time.Minute
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	// The first pass only annotates the node, and until the wait is over it
+	// is left alone.
+	for i := 0; i < 2; i++ {
+		err := r.Reconcile(context.Background())
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 0, deletes)
+
+	since, ok := pendingDeleteSince(*node)
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), since, time.Minute)
+
+	// The annotation is removed once the instance is running again, so the
+	// wait starts over if it goes away for good.
+	instances["i-flapping"] = ec2.InstanceStateNameRunning
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+
+	_, ok = pendingDeleteSince(*node)
+	assert.False(t, ok)
+
+	instances["i-flapping"] = ec2.InstanceStateNameTerminated
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, deletes)
+
+	_, ok = pendingDeleteSince(*node)
+	assert.True(t, ok)
+
+	// The wait is read back from the node, so a restarted Reconciler still
+	// deletes it once the wait is over.
+	node.ObjectMeta.Annotations[AnnotationPendingDelete] = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	r = newTestReconciler(t, clients, clientset, opts)
+
+	err = r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deletes)
+}
+
+func TestReconcileCordonOnly(t *testing.T) {
+	reviewed := testNode("reviewed", "i-reviewed", v1.ConditionFalse)
+	reviewed.Spec.Unschedulable = true
+	reviewed.ObjectMeta.Labels = map[string]string{LabelCandidate: "true"}
+
+	clientset := fake.NewSimpleClientset(testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse), reviewed)
+
+	// The fake clientset can't apply patches, so record them instead.
+	var patches []string
+
+	clientset.PrependReactor("patch", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		patches = append(patches, action.(core.PatchActionImpl).GetName()+" "+string(action.(core.PatchActionImpl).GetPatch()))
+		return true, &v1.Node{}, nil
+	})
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-terminated": ec2.InstanceStateNameTerminated,
+					"i-reviewed":   ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.CordonOnly = true
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+
+	// Nodes which have already been cordoned for review are left alone.
+	assert.Equal(t, []string{
+		`not-ready-terminated {"metadata":{"labels":{"k8s-aws-cleanup/candidate":"true"}},"spec":{"unschedulable":true}}`,
+	}, patches)
+	assert.Equal(t, 1, r.last.cordoned)
+	assert.Equal(t, 0, r.last.deleted)
+	assert.Equal(t, []string{"not-ready-terminated", "reviewed"}, remainingNodes(t, clientset))
+	assert.Equal(t, []string{"Normal NodeCleanup Cordoned node for review: node is not ready and its instance is terminated"}, recordedEvents(r))
+}
+
+func TestReconcileMaxDeletions(t *testing.T) {
+	var buf bytes.Buffer
+
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	clientset := fake.NewSimpleClientset(
+		testNode("terminated1", "i-terminated1", v1.ConditionFalse),
+		testNode("terminated2", "i-terminated2", v1.ConditionFalse),
+		testNode("terminated3", "i-terminated3", v1.ConditionFalse),
+		testNode("terminated4", "i-terminated4", v1.ConditionFalse),
+		testNode("terminated5", "i-terminated5", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-terminated1": ec2.InstanceStateNameTerminated,
+					"i-terminated2": ec2.InstanceStateNameTerminated,
+					"i-terminated3": ec2.InstanceStateNameTerminated,
+					"i-terminated4": ec2.InstanceStateNameTerminated,
+					"i-terminated5": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.MaxDeletions = 2
+
+	r := newTestReconciler(t, clients, clientset, opts)
+
+	err := r.Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, r.last.deleted)
+
+	remaining := remainingNodes(t, clientset)
+	assert.Len(t, remaining, 3)
+
+	// Every node over the cap is logged, so it's clear why they are still around.
+	var capped []string
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+
+		err := json.Unmarshal([]byte(line), &entry)
+		assert.Nil(t, err)
+
+		switch entry["msg"] {
+		case "Maximum deletions per pass reached, skipping until next pass":
+			capped = append(capped, entry["node"].(string))
+		case "MAXIMUM DELETIONS PER PASS REACHED":
+			assert.Equal(t, float64(2), entry["max_deletions"])
+			assert.Equal(t, float64(5), entry["candidates"])
+		}
+	}
+
+	sort.Strings(capped)
+	assert.Equal(t, remaining, capped)
+}
+
+func TestReconcileMaxDeletionFraction(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("ready", "i-ready", v1.ConditionTrue),
+		testNode("terminated1", "i-terminated1", v1.ConditionFalse),
+		testNode("terminated2", "i-terminated2", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-ready":       ec2.InstanceStateNameRunning,
+					"i-terminated1": ec2.InstanceStateNameTerminated,
+					"i-terminated2": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	safetyErrors := func() float64 {
+		var m dto.Metric
+		metricReconcileErrors.WithLabelValues(stageSafety).Write(&m)
+		return m.GetCounter().GetValue()
+	}
+
+	before := safetyErrors()
+
+	// Two of three nodes is more than half the cluster, so none are deleted.
+	opts := testOptions()
+	opts.MaxDeletionFraction = 0.5
+
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.EqualError(t, err, "2 of 3 nodes are candidates for deletion, more than the maximum fraction of 0.5")
+	assert.Equal(t, []string{"ready", "terminated1", "terminated2"}, remainingNodes(t, clientset))
+	assert.Equal(t, before+1, safetyErrors())
+
+	opts.MaxDeletionFraction = 0.7
+
+	err = newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ready"}, remainingNodes(t, clientset))
+	assert.Equal(t, before+1, safetyErrors())
+}
+
+func TestReconcileMinExpectedNodes(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("ready", "i-ready", v1.ConditionTrue),
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+	)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{
+					"i-ready":      ec2.InstanceStateNameRunning,
+					"i-terminated": ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	opts := testOptions()
+	opts.MinExpectedNodes = 3
+
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.NotNil(t, err)
+	assert.False(t, IsUnavailable(err))
+	assert.Equal(t, []string{"not-ready-terminated", "ready"}, remainingNodes(t, clientset))
+
+	opts.MinExpectedNodes = 2
+
+	err = newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ready"}, remainingNodes(t, clientset))
+}
+
+func TestReconcileStateMismatch(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("ready-terminated", "i-terminated", v1.ConditionTrue))
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {
+			EC2: &fakeEC2{
+				instances: map[string]string{"i-terminated": ec2.InstanceStateNameTerminated},
+			},
+		},
+	}
+
+	mismatches := func() float64 {
+		var m dto.Metric
+		metricNodeStateMismatch.Write(&m)
+		return m.GetCounter().GetValue()
+	}
+
+	before := mismatches()
+
+	// The node claims to be ready, so it is kept.
+	err := newTestReconciler(t, clients, clientset, testOptions()).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ready-terminated"}, remainingNodes(t, clientset))
+	assert.Equal(t, before+1, mismatches())
+
+	// Nothing is known about the instance when it isn't looked up at all.
+	opts := testOptions()
+	opts.SkipInstanceCheck = true
+	opts.NotReadyGrace = time.Hour
+
+	err = newTestReconciler(t, map[string]RegionClient{}, clientset, opts).Reconcile(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ready-terminated"}, remainingNodes(t, clientset))
+	assert.Equal(t, before+1, mismatches())
+}
+
+func TestReconcileDescribeError(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("not-ready", "i-123", v1.ConditionFalse))
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {EC2: &failingEC2{err: context.DeadlineExceeded}},
+	}
+
+	// Nodes must never be deleted because their instance couldn't be looked up.
+	r := newTestReconciler(t, clients, clientset, testOptions())
+
+	err := r.Reconcile(context.Background())
+	assert.True(t, IsUnavailable(err))
+	assert.Equal(t, []string{"not-ready"}, remainingNodes(t, clientset))
+	assert.Equal(t, map[string]bool{"not-ready": true}, r.requeue)
+}
+
+func TestReconcileDescribeErrorNodeAgeMax(t *testing.T) {
+	recent := testNode("recent", "i-recent", v1.ConditionFalse)
+	recent.ObjectMeta.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+
+	clientset := fake.NewSimpleClientset(testNode("ancient", "i-ancient", v1.ConditionFalse), recent)
+
+	clients := map[string]RegionClient{
+		"ap-southeast-2": {EC2: &failingEC2{err: context.DeadlineExceeded}},
+	}
+
+	opts := testOptions()
+	opts.NodeAgeMax = 24 * time.Hour
+
+	// Only nodes which have been around long enough are deleted without
+	// their instance, the pass still fails so it backs off.
+	err := newTestReconciler(t, clients, clientset, opts).Reconcile(context.Background())
+	assert.True(t, IsUnavailable(err))
+	assert.Equal(t, []string{"recent"}, remainingNodes(t, clientset))
+}
+
+func TestDeleteOptions(t *testing.T) {
+	assert.Equal(t, &metav1.DeleteOptions{}, deleteOptions(nil, ""))
+
+	grace := int64(30)
+	background := metav1.DeletePropagationBackground
+
+	assert.Equal(t, &metav1.DeleteOptions{
+		GracePeriodSeconds: &grace,
+		PropagationPolicy:  &background,
+	}, deleteOptions(&grace, metav1.DeletePropagationBackground))
+}
+
+func TestJittered(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		interval := jittered(100*time.Second, 0.1)
+		assert.True(t, interval >= 90*time.Second && interval <= 110*time.Second, interval)
+	}
+
+	assert.Equal(t, 100*time.Second, jittered(100*time.Second, 0))
+}
+
+func TestNextInterval(t *testing.T) {
+	base := 2 * time.Minute
+	max := 10 * time.Minute
+
+	assert.Equal(t, 4*time.Minute, nextInterval(base, base, max, true))
+	assert.Equal(t, 8*time.Minute, nextInterval(4*time.Minute, base, max, true))
+	assert.Equal(t, max, nextInterval(8*time.Minute, base, max, true))
+	assert.Equal(t, max, nextInterval(max, base, max, true))
+	assert.Equal(t, base, nextInterval(max, base, max, false))
+
+	// Backing off is disabled by default.
+	assert.Equal(t, base, nextInterval(base, base, 0, true))
+}
+
+func TestIsUnavailable(t *testing.T) {
+	assert.True(t, IsUnavailable(&unavailableError{fmt.Errorf("failed to lookup node list")}))
+	assert.True(t, IsUnavailable(fmt.Errorf("pass failed: %w", &unavailableError{fmt.Errorf("timeout")})))
+	assert.False(t, IsUnavailable(fmt.Errorf("failed to delete 1 nodes")))
+	assert.False(t, IsUnavailable(nil))
+}
+
+func TestIsPartial(t *testing.T) {
+	assert.True(t, IsPartial(&partialError{errors.New("failed to delete 1 nodes")}))
+	assert.False(t, IsPartial(&unavailableError{errors.New("failed to lookup node list")}))
+	assert.False(t, IsPartial(errors.New("listed 0 nodes, fewer than the minimum expected of 3")))
+	assert.False(t, IsPartial(nil))
+}
+
+func TestLivenessTimeout(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, 4*time.Minute, newTestReconciler(t, nil, fake.NewSimpleClientset(), opts).livenessTimeout())
+
+	// Backing off while the APIs are unavailable isn't being stuck.
+	opts.FrequencyMaxBackoff = 10 * time.Minute
+	assert.Equal(t, 20*time.Minute, newTestReconciler(t, nil, fake.NewSimpleClientset(), opts).livenessTimeout())
+
+	opts.FrequencyMaxBackoff = 0
+
+	// A single node can take this long, however often passes run.
+	opts.Drain = true
+	opts.PreDeleteExec = "/bin/true"
+	opts.PreDeleteTimeout = time.Minute
+	assert.Equal(t, 10*time.Minute, newTestReconciler(t, nil, fake.NewSimpleClientset(), opts).livenessTimeout())
+}
+
+func TestNewInvalidOptions(t *testing.T) {
+	_, err := New(nil, fake.NewSimpleClientset(), record.NewFakeRecorder(100), Options{})
+	assert.EqualError(t, err, "frequency must be greater than 0: 0s")
+
+	opts := testOptions()
+	opts.Jitter = 1
+	_, err = New(nil, fake.NewSimpleClientset(), record.NewFakeRecorder(100), opts)
+	assert.EqualError(t, err, "jitter must be at least 0 and less than 1: 1")
+
+	opts = testOptions()
+	opts.Concurrency = 0
+	_, err = New(nil, fake.NewSimpleClientset(), record.NewFakeRecorder(100), opts)
+	assert.EqualError(t, err, "concurrency must be at least 1: 0")
+
+	opts = testOptions()
+	opts.RequestTimeout = 0
+	_, err = New(nil, fake.NewSimpleClientset(), record.NewFakeRecorder(100), opts)
+	assert.EqualError(t, err, "request timeout must be greater than 0: 0s")
+}
+
+func TestReconcileSafetyAbortIsProgress(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("ready", "i-ready", v1.ConditionTrue))
+
+	opts := testOptions()
+	opts.MinExpectedNodes = 3
+
+	r := newTestReconciler(t, map[string]RegionClient{}, clientset, opts)
+	r.health.lastProgress = time.Now().Add(-time.Hour)
+
+	err := r.Reconcile(context.Background())
+	assert.NotNil(t, err)
+
+	r.health.Lock()
+	defer r.health.Unlock()
+
+	assert.True(t, time.Since(r.health.lastProgress) < time.Minute, r.health.lastProgress)
+}
+
+func TestParallel(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		running, peak int
+		done          = make([]bool, 20)
+	)
+
+	parallel(len(done), 3, func(i int) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		done[i] = true
+		mu.Unlock()
+	})
+
+	assert.True(t, peak <= 3, peak)
+	assert.NotContains(t, done, false)
+
+	// Without a usable limit the calls still run, one at a time.
+	var calls int
+
+	parallel(5, 0, func(i int) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	})
+
+	assert.Equal(t, 5, calls)
+}
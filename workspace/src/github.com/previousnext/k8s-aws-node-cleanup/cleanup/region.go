@@ -0,0 +1,87 @@
+package cleanup
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Labels the kubelet sets with the availability zone a node is running in.
+const (
+	labelZone           = "topology.kubernetes.io/zone"
+	labelZoneDeprecated = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// RegionClient holds the AWS clients for a single region.
+type RegionClient struct {
+	EC2 EC2API
+
+	// Only needed when Auto Scaling groups are checked, with
+	// Options.CheckASGLifecycle or Options.RespectProtection.
+	ASG AutoscalingAPI
+}
+
+// Helper function to determine which region's clients should be used to look
+// up the instance backing a node. The region comes from the availability zone
+// in the node's ProviderID or zone labels. Nodes which don't say where they
+// are can only be looked up when there is a single region to look in.
+func nodeRegion(node v1.Node, clients map[string]RegionClient) (string, error) {
+	zone := nodeZone(node)
+
+	if zone == "" {
+		if len(clients) == 1 {
+			for region := range clients {
+				return region, nil
+			}
+		}
+
+		return "", fmt.Errorf("cannot determine availability zone")
+	}
+
+	region := zoneRegion(zone)
+
+	if _, ok := clients[region]; !ok {
+		return "", fmt.Errorf("no aws client for region: %s", region)
+	}
+
+	return region, nil
+}
+
+// Helper function to find the availability zone a node is running in, from
+// its ProviderID in the form aws:///<zone>/<instance id> or its zone labels.
+func nodeZone(node v1.Node) string {
+	if strings.HasPrefix(node.Spec.ProviderID, "aws://") {
+		parts := strings.Split(strings.TrimPrefix(node.Spec.ProviderID, "aws://"), "/")
+		if len(parts) == 3 && parts[1] != "" {
+			return parts[1]
+		}
+	}
+
+	if zone := node.ObjectMeta.Labels[labelZone]; zone != "" {
+		return zone
+	}
+
+	return node.ObjectMeta.Labels[labelZoneDeprecated]
+}
+
+// Helper function to convert an availability zone to its region, eg.
+// ap-southeast-2a to ap-southeast-2. Local and Wavelength Zones carry more
+// after the region, eg. us-west-2-lax-1a and us-east-1-wl1-bos-wlz-1, so the
+// region ends at the number following its name rather than a fixed position.
+func zoneRegion(zone string) string {
+	parts := strings.Split(zone, "-")
+
+	for i, part := range parts {
+		n := 0
+		for n < len(part) && part[n] >= '0' && part[n] <= '9' {
+			n++
+		}
+
+		if n > 0 {
+			return strings.Join(append(parts[:i:i], part[:n]), "-")
+		}
+	}
+
+	return zone
+}
@@ -0,0 +1,98 @@
+package cleanup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestNodeRegion(t *testing.T) {
+	multi := map[string]RegionClient{
+		"ap-southeast-2": {EC2: &fakeEC2{}},
+		"us-east-1":      {EC2: &fakeEC2{}},
+	}
+
+	single := map[string]RegionClient{
+		"ap-southeast-2": {EC2: &fakeEC2{}},
+	}
+
+	tests := []struct {
+		name    string
+		node    v1.Node
+		clients map[string]RegionClient
+		region  string
+		err     bool
+	}{
+		{
+			name:    "provider id",
+			node:    v1.Node{Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-123"}},
+			clients: multi,
+			region:  "us-east-1",
+		},
+		{
+			name:    "local zone",
+			node:    v1.Node{Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1-bos-1a/i-123"}},
+			clients: multi,
+			region:  "us-east-1",
+		},
+		{
+			name:    "zone label",
+			node:    v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{labelZone: "ap-southeast-2b"}}},
+			clients: multi,
+			region:  "ap-southeast-2",
+		},
+		{
+			name:    "deprecated zone label",
+			node:    v1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{labelZoneDeprecated: "us-east-1c"}}},
+			clients: multi,
+			region:  "us-east-1",
+		},
+		{
+			name:    "unknown region",
+			node:    v1.Node{Spec: v1.NodeSpec{ProviderID: "aws:///eu-west-1a/i-123"}},
+			clients: multi,
+			err:     true,
+		},
+		{
+			name:    "out of region with a single region",
+			node:    v1.Node{Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-123"}},
+			clients: single,
+			err:     true,
+		},
+		{
+			name:    "no zone with multiple regions",
+			node:    v1.Node{Spec: v1.NodeSpec{ExternalID: "i-123"}},
+			clients: multi,
+			err:     true,
+		},
+		{
+			name:    "no zone with a single region",
+			node:    v1.Node{Spec: v1.NodeSpec{ExternalID: "i-123"}},
+			clients: single,
+			region:  "ap-southeast-2",
+		},
+	}
+
+	for _, test := range tests {
+		region, err := nodeRegion(test.node, test.clients)
+		assert.Equal(t, test.region, region, test.name)
+		assert.Equal(t, test.err, err != nil, test.name)
+	}
+}
+
+func TestZoneRegion(t *testing.T) {
+	assert.Equal(t, "ap-southeast-2", zoneRegion("ap-southeast-2a"))
+	assert.Equal(t, "us-east-1", zoneRegion("us-east-1f"))
+	assert.Equal(t, "us-east-1", zoneRegion("us-east-1"))
+	assert.Equal(t, "us-gov-west-1", zoneRegion("us-gov-west-1a"))
+
+	// Local Zones.
+	assert.Equal(t, "us-west-2", zoneRegion("us-west-2-lax-1a"))
+	assert.Equal(t, "us-east-1", zoneRegion("us-east-1-bos-1a"))
+
+	// Wavelength Zones.
+	assert.Equal(t, "us-east-1", zoneRegion("us-east-1-wl1-bos-wlz-1"))
+	assert.Equal(t, "ap-northeast-1", zoneRegion("ap-northeast-1-wl1-nrt-wlz-1"))
+}
@@ -0,0 +1,58 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A node which qualified for deletion, as written to the report file.
+type reportEntry struct {
+	Node       string    `json:"node"`
+	Created    time.Time `json:"created"`
+	InstanceID string    `json:"instance_id"`
+	State      string    `json:"state"`
+	Reason     string    `json:"reason"`
+}
+
+// Helper function to write the candidates of a pass to a file as a JSON array,
+// replacing whatever the last pass wrote. The file is written alongside and
+// renamed into place, so readers never see half a report.
+func writeReport(path string, candidates []candidate) error {
+	entries := make([]reportEntry, 0, len(candidates))
+
+	for _, c := range candidates {
+		entries = append(entries, reportEntry{
+			Node:       c.node.ObjectMeta.Name,
+			Created:    c.node.ObjectMeta.CreationTimestamp.Time.UTC(),
+			InstanceID: c.instanceID,
+			State:      c.state,
+			Reason:     deletionReason(c.state),
+		})
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,52 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestWriteReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+
+	created := time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	candidates := []candidate{
+		{
+			node:       v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", CreationTimestamp: metav1.NewTime(created)}},
+			instanceID: "i-123",
+			state:      ec2.InstanceStateNameTerminated,
+		},
+	}
+
+	err := writeReport(path, candidates)
+	assert.Nil(t, err)
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	var entries []reportEntry
+
+	err = json.Unmarshal(data, &entries)
+	assert.Nil(t, err)
+	assert.Equal(t, []reportEntry{{Node: "node1", Created: created, InstanceID: "i-123", State: ec2.InstanceStateNameTerminated, Reason: "node is not ready and its instance is terminated"}}, entries)
+
+	// Later passes replace the report, rather than adding to it.
+	err = writeReport(path, nil)
+	assert.Nil(t, err)
+
+	data, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "[]\n", string(data))
+
+	files, err := os.ReadDir(filepath.Dir(path))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
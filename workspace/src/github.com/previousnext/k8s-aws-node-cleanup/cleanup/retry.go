@@ -0,0 +1,186 @@
+package cleanup
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// The delay before the first retry, doubled for every retry after that.
+	retryBaseDelay = 500 * time.Millisecond
+
+	// The longest we will wait between two attempts.
+	retryMaxDelay = 20 * time.Second
+)
+
+// Error codes AWS returns when we are being throttled or it is having trouble.
+var retryableCodes = map[string]bool{
+	"RequestLimitExceeded": true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestThrottled":     true,
+	"InternalError":        true,
+	"ServiceUnavailable":   true,
+	"Unavailable":          true,
+}
+
+// Wraps an EC2 client, retrying calls which were throttled or failed on the
+// AWS side with exponential backoff and jitter.
+type retryingEC2 struct {
+	EC2API
+
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+// NewRetryingEC2 wraps an EC2 client so calls are retried up to maxRetries times.
+func NewRetryingEC2(svc EC2API, maxRetries int) EC2API {
+	return &retryingEC2{
+		EC2API:     svc,
+		maxRetries: maxRetries,
+		baseDelay:  retryBaseDelay,
+	}
+}
+
+// DescribeInstancesWithContext describes instances, retrying transient failures.
+func (r *retryingEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	var resp *ec2.DescribeInstancesOutput
+
+	err := r.retry(ctx, func() error {
+		var err error
+		resp, err = r.EC2API.DescribeInstancesWithContext(ctx, input, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// DescribeInstanceAttributeWithContext describes an instance attribute,
+// retrying transient failures.
+func (r *retryingEC2) DescribeInstanceAttributeWithContext(ctx aws.Context, input *ec2.DescribeInstanceAttributeInput, opts ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	var resp *ec2.DescribeInstanceAttributeOutput
+
+	err := r.retry(ctx, func() error {
+		var err error
+		resp, err = r.EC2API.DescribeInstanceAttributeWithContext(ctx, input, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// DescribeInstanceStatusWithContext describes the status of instances,
+// retrying transient failures.
+func (r *retryingEC2) DescribeInstanceStatusWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, opts ...request.Option) (*ec2.DescribeInstanceStatusOutput, error) {
+	var resp *ec2.DescribeInstanceStatusOutput
+
+	err := r.retry(ctx, func() error {
+		var err error
+		resp, err = r.EC2API.DescribeInstanceStatusWithContext(ctx, input, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// TerminateInstancesWithContext terminates instances, retrying transient
+// failures. Terminating an instance twice is harmless.
+func (r *retryingEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	var resp *ec2.TerminateInstancesOutput
+
+	err := r.retry(ctx, func() error {
+		var err error
+		resp, err = r.EC2API.TerminateInstancesWithContext(ctx, input, opts...)
+		return err
+	})
+
+	return resp, err
+}
+
+// Helper function to call fn until it succeeds, fails with an error which
+// isn't worth retrying, or we run out of retries.
+func (r *retryingEC2) retry(ctx aws.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.maxRetries || !isRetryable(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(r.baseDelay, attempt)):
+		}
+	}
+}
+
+// Helper function to check if an AWS error is worth retrying. Instances which
+// no longer exist will never come back, so those are not.
+func isRetryable(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		return retryableCodes[aerr.Code()]
+	}
+
+	return false
+}
+
+// Helper function to delete a node, retrying up to maxRetries times while the
+// API server is throttling us. We wait as long as it asks with Retry-After
+// (up to retryMaxDelay), or back off from baseDelay when it doesn't say.
+func deleteRetrying(ctx context.Context, clientset kubernetes.Interface, name string, options *metav1.DeleteOptions, maxRetries int, baseDelay time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		err := clientset.CoreV1().Nodes().Delete(name, options)
+
+		delay, throttled := retryAfter(err)
+		if err == nil || attempt >= maxRetries || !throttled {
+			return err
+		}
+
+		if delay <= 0 || delay > retryMaxDelay {
+			delay = backoff(baseDelay, attempt)
+		}
+
+		slog.Warn("Deleting node was throttled, retrying", "node", name, "action", "delete", "attempt", attempt+1, "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Helper function to check if the API server asked us to slow down, and how
+// long it asked us to wait when it said.
+func retryAfter(err error) (time.Duration, bool) {
+	if seconds, ok := kerrors.SuggestsClientDelay(err); ok {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	return 0, kerrors.IsTooManyRequests(err)
+}
+
+// Helper function to calculate how long to wait before the given retry
+// attempt, using "equal jitter" so concurrent callers spread out.
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,195 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	core "k8s.io/client-go/testing"
+)
+
+// Fake EC2 client which returns a sequence of errors before succeeding.
+type flakyEC2 struct {
+	errs  []error
+	calls int
+}
+
+func (f *flakyEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	f.calls++
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+
+	return &ec2.DescribeInstancesOutput{}, nil
+}
+
+func (f *flakyEC2) DescribeInstanceAttributeWithContext(ctx aws.Context, input *ec2.DescribeInstanceAttributeInput, opts ...request.Option) (*ec2.DescribeInstanceAttributeOutput, error) {
+	f.calls++
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+
+	return &ec2.DescribeInstanceAttributeOutput{}, nil
+}
+
+func (f *flakyEC2) DescribeInstanceStatusWithContext(ctx aws.Context, input *ec2.DescribeInstanceStatusInput, opts ...request.Option) (*ec2.DescribeInstanceStatusOutput, error) {
+	f.calls++
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+
+	return &ec2.DescribeInstanceStatusOutput{}, nil
+}
+
+func (f *flakyEC2) TerminateInstancesWithContext(ctx aws.Context, input *ec2.TerminateInstancesInput, opts ...request.Option) (*ec2.TerminateInstancesOutput, error) {
+	f.calls++
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func TestRetryingEC2(t *testing.T) {
+	throttled := awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+
+	svc := &flakyEC2{errs: []error{throttled, throttled}}
+	r := &retryingEC2{EC2API: svc, maxRetries: 3, baseDelay: time.Millisecond}
+
+	_, err := r.DescribeInstancesWithContext(context.Background(), &ec2.DescribeInstancesInput{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, svc.calls)
+}
+
+func TestRetryingEC2GivesUp(t *testing.T) {
+	throttled := awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+
+	svc := &flakyEC2{errs: []error{throttled, throttled, throttled}}
+	r := &retryingEC2{EC2API: svc, maxRetries: 1, baseDelay: time.Millisecond}
+
+	_, err := r.DescribeInstancesWithContext(context.Background(), &ec2.DescribeInstancesInput{})
+	assert.Equal(t, throttled, err)
+	assert.Equal(t, 2, svc.calls)
+}
+
+func TestRetryingEC2NotFound(t *testing.T) {
+	notFound := awserr.New(errCodeInstanceNotFound, "The instance ID 'i-123' does not exist", nil)
+
+	svc := &flakyEC2{errs: []error{notFound}}
+	r := &retryingEC2{EC2API: svc, maxRetries: 3, baseDelay: time.Millisecond}
+
+	_, err := r.DescribeInstancesWithContext(context.Background(), &ec2.DescribeInstancesInput{})
+	assert.Equal(t, notFound, err)
+	assert.Equal(t, 1, svc.calls)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(awserr.New("Throttling", "Rate exceeded", nil)))
+	assert.True(t, isRetryable(awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 503, "abc")))
+	assert.False(t, isRetryable(awserr.NewRequestFailure(awserr.New("UnauthorizedOperation", "", nil), 403, "abc")))
+	assert.False(t, isRetryable(awserr.New(errCodeInstanceNotFound, "", nil)))
+	assert.False(t, isRetryable(context.DeadlineExceeded))
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := backoff(time.Second, attempt)
+		max := time.Second << uint(attempt)
+		if max > retryMaxDelay {
+			max = retryMaxDelay
+		}
+
+		assert.True(t, delay >= max/2 && delay <= max, delay)
+	}
+}
+
+func TestDeleteRetrying(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("node1", "i-1", v1.ConditionFalse))
+
+	// Throttled twice, once without saying for how long.
+	errs := []error{
+		kerrors.NewGenericServerResponse(kerrors.StatusTooManyRequests, "delete", schema.GroupResource{Resource: "nodes"}, "node1", "", 0, false),
+		kerrors.NewGenericServerResponse(kerrors.StatusTooManyRequests, "delete", schema.GroupResource{Resource: "nodes"}, "node1", "", 1, false),
+	}
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		if len(errs) == 0 {
+			return false, nil, nil
+		}
+
+		err := errs[0]
+		errs = errs[1:]
+
+		return true, nil, err
+	})
+
+	err := deleteRetrying(context.Background(), clientset, "node1", nil, 3, time.Millisecond)
+	assert.Nil(t, err)
+	assert.Empty(t, remainingNodes(t, clientset))
+}
+
+func TestDeleteRetryingGivesUp(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testNode("node1", "i-1", v1.ConditionFalse))
+
+	var calls int
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		calls++
+		return true, nil, kerrors.NewGenericServerResponse(kerrors.StatusTooManyRequests, "delete", schema.GroupResource{Resource: "nodes"}, "node1", "", 0, false)
+	})
+
+	err := deleteRetrying(context.Background(), clientset, "node1", nil, 2, time.Millisecond)
+	assert.True(t, kerrors.IsTooManyRequests(err))
+	assert.Equal(t, 3, calls)
+
+	// Errors other than throttling are not retried.
+	calls = 0
+
+	clientset.PrependReactor("delete", "nodes", func(action core.Action) (bool, runtime.Object, error) {
+		calls++
+		return true, nil, errors.New("finalizer is stuck")
+	})
+
+	err = deleteRetrying(context.Background(), clientset, "node1", nil, 2, time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryAfter(t *testing.T) {
+	delay, ok := retryAfter(kerrors.NewGenericServerResponse(kerrors.StatusTooManyRequests, "delete", schema.GroupResource{Resource: "nodes"}, "node1", "", 7, false))
+	assert.True(t, ok)
+	assert.Equal(t, 7*time.Second, delay)
+
+	delay, ok = retryAfter(kerrors.NewServerTimeout(schema.GroupResource{Resource: "nodes"}, "delete", 2))
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, delay)
+
+	_, ok = retryAfter(kerrors.NewNotFound(schema.GroupResource{Resource: "nodes"}, "node1"))
+	assert.False(t, ok)
+
+	_, ok = retryAfter(nil)
+	assert.False(t, ok)
+}
@@ -0,0 +1,49 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"k8s.io/client-go/kubernetes"
+)
+
+// An instance ID which can never exist, so the self test describes nothing.
+const selfTestInstanceID = "i-00000000000000000"
+
+// SelfTestEC2 checks we are allowed to describe EC2 instances, so missing IAM
+// permissions fail at startup rather than on every pass.
+func SelfTestEC2(svc EC2API, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Filtering, rather than asking for the ID, returns an empty result
+	// instead of a not found error.
+	_, err := svc.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("instance-id"),
+				Values: aws.StringSlice([]string{selfTestInstanceID}),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot describe ec2 instances: %v", err)
+	}
+
+	return nil
+}
+
+// SelfTestKubernetes checks we are allowed to list nodes, so missing RBAC
+// permissions fail at startup rather than on every pass.
+func SelfTestKubernetes(clientset kubernetes.Interface) error {
+	// The typed List can't set a limit in this version of client-go.
+	_, err := clientset.CoreV1().RESTClient().Get().Resource("nodes").Param("limit", "1").DoRaw()
+	if err != nil {
+		return fmt.Errorf("cannot list nodes: %v", err)
+	}
+
+	return nil
+}
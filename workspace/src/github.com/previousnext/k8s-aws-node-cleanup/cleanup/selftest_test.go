@@ -0,0 +1,39 @@
+package cleanup
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestSelfTest(t *testing.T) {
+	status := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"kind":"NodeList","apiVersion":"v1","metadata":{},"items":[]}`)
+	}))
+	defer server.Close()
+
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	assert.Nil(t, err)
+
+	assert.Nil(t, SelfTestKubernetes(clientset))
+
+	status = http.StatusForbidden
+
+	err = SelfTestKubernetes(clientset)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, SelfTestEC2(&fakeEC2{}, time.Second))
+
+	err = SelfTestEC2(&failingEC2{err: fmt.Errorf("UnauthorizedOperation")}, time.Second)
+	assert.NotNil(t, err)
+}
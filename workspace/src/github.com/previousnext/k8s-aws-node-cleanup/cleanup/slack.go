@@ -0,0 +1,75 @@
+package cleanup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long to wait for Slack to accept a message.
+const slackTimeout = 10 * time.Second
+
+// Posts messages to a Slack incoming webhook in the background, so a slow or
+// broken webhook never holds up node cleanup.
+type slackNotifier struct {
+	url    string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// Helper function to notify Slack about deleted nodes, when a webhook has been
+// configured.
+func newSlackNotifier(n Notifications) *slackNotifier {
+	return &slackNotifier{
+		url:    n.SlackWebhook,
+		client: &http.Client{Timeout: slackTimeout},
+	}
+}
+
+// NodeDeleted posts a message about a deleted node.
+func (s *slackNotifier) NodeDeleted(node, instanceID, reason string) {
+	if s.url == "" {
+		return
+	}
+
+	text := fmt.Sprintf("Deleted node `%s` (instance `%s`): %s", node, instanceID, reason)
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		err := s.post(text)
+		if err != nil {
+			slog.Error("Failed to post to Slack", "node", node, "instance_id", instanceID, "error", err)
+		}
+	}()
+}
+
+// Wait blocks until all messages have been posted.
+func (s *slackNotifier) Wait() {
+	s.wg.Wait()
+}
+
+func (s *slackNotifier) post(text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlackNotifier(t *testing.T) {
+	var messages []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		messages = append(messages, payload["text"])
+	}))
+	defer server.Close()
+
+	s := &slackNotifier{url: server.URL, client: server.Client()}
+	s.NodeDeleted("node1", "i-123", "instance is terminated")
+	s.Wait()
+
+	assert.Equal(t, []string{"Deleted node `node1` (instance `i-123`): instance is terminated"}, messages)
+}
+
+func TestSlackNotifierDisabled(t *testing.T) {
+	s := &slackNotifier{client: http.DefaultClient}
+	s.NodeDeleted("node1", "i-123", "instance is terminated")
+	s.Wait()
+}
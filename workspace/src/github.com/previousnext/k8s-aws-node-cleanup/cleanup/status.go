@@ -0,0 +1,72 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Keeps an operational snapshot of the cleanup loop, so operators can see how
+// it is going without a metrics stack.
+type status struct {
+	sync.Mutex
+
+	lastPass   *PassReport
+	lastErrors map[string]stageError
+}
+
+// The most recent error in a stage of a pass.
+type stageError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// The snapshot served on /status.
+type statusReport struct {
+	LastPass   *PassReport           `json:"last_pass"`
+	LastErrors map[string]stageError `json:"last_errors"`
+}
+
+// Failed records an error in a stage of a pass.
+func (s *status) Failed(stage string, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.lastErrors == nil {
+		s.lastErrors = make(map[string]stageError)
+	}
+
+	s.lastErrors[stage] = stageError{Error: err.Error(), Time: time.Now()}
+}
+
+// Finished records how the last pass went.
+func (s *status) Finished(report PassReport) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastPass = &report
+}
+
+// Status serves the last pass and the last error in each stage as JSON.
+func (s *status) Status(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	report := statusReport{
+		LastPass:   s.lastPass,
+		LastErrors: make(map[string]stageError),
+	}
+
+	for stage, err := range s.lastErrors {
+		report.LastErrors[stage] = err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Status serves the last pass, and the last error in each stage, as JSON.
+func (r *Reconciler) Status(w http.ResponseWriter, req *http.Request) {
+	r.status.Status(w, req)
+}
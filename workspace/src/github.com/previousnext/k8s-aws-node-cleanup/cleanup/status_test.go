@@ -0,0 +1,44 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	s := &status{}
+
+	get := func() statusReport {
+		w := httptest.NewRecorder()
+		s.Status(w, httptest.NewRequest("GET", "/status", nil))
+
+		var report statusReport
+
+		err := json.Unmarshal(w.Body.Bytes(), &report)
+		assert.Nil(t, err)
+
+		return report
+	}
+
+	assert.Equal(t, statusReport{LastErrors: map[string]stageError{}}, get())
+
+	s.Failed(stageList, errors.New("connection refused"))
+	s.Failed(stageDelete, errors.New("first"))
+	s.Failed(stageDelete, errors.New("second"))
+
+	pass := summary{started: time.Now(), listed: 3, deleted: 1}
+	s.Finished(pass.Report(false, nil))
+
+	report := get()
+	assert.Equal(t, 3, report.LastPass.Listed)
+	assert.Equal(t, 1, report.LastPass.Deleted)
+	assert.Len(t, report.LastErrors, 2)
+	assert.Equal(t, "connection refused", report.LastErrors[stageList].Error)
+	assert.Equal(t, "second", report.LastErrors[stageDelete].Error)
+	assert.False(t, report.LastErrors[stageDelete].Time.IsZero())
+}
@@ -0,0 +1,128 @@
+package cleanup
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Tallies what happened to the nodes during a single reconcile pass.
+type summary struct {
+	started time.Time
+
+	// The resource version of the node list the pass acted on.
+	resourceVersion string
+
+	listed    int
+	inspected int
+	ready     int
+	running   int
+	deleted   int
+	cordoned  int
+	errors    int
+
+	// Nodes which were (or in dry-run mode, would have been) deleted.
+	candidates []candidate
+
+	// The names of the nodes which were deleted.
+	deletedNodes []string
+
+	// Nodes which hit an error, keyed by node name.
+	errored map[string]bool
+}
+
+// A node which qualified for deletion.
+type candidate struct {
+	node       v1.Node
+	instanceID string
+	region     string
+	state      string
+
+	// Whether to terminate the instance before deleting the node.
+	terminate bool
+}
+
+// Helper function to count an error inspecting or deleting a node.
+func (s *summary) nodeError(name string) {
+	s.errors++
+	s.errored[name] = true
+}
+
+// PassReport is what a pass did, as reported to whoever triggered it.
+type PassReport struct {
+	Started         time.Time         `json:"started"`
+	Duration        string            `json:"duration"`
+	DryRun          bool              `json:"dry_run"`
+	ResourceVersion string            `json:"resource_version"`
+	Listed          int               `json:"listed"`
+	Inspected       int               `json:"inspected"`
+	Ready           int               `json:"skipped_ready"`
+	Running         int               `json:"skipped_running"`
+	Deleted         int               `json:"deleted"`
+	Cordoned        int               `json:"cordoned"`
+	Errors          int               `json:"errors"`
+	Candidates      []CandidateReport `json:"candidates"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// CandidateReport is a node which qualified for deletion, as reported to
+// whoever triggered a pass.
+type CandidateReport struct {
+	Node       string `json:"node"`
+	InstanceID string `json:"instance_id"`
+	State      string `json:"state"`
+}
+
+// Report describes how the pass went, and how it ended when err is set.
+func (s *summary) Report(dryRun bool, err error) PassReport {
+	report := PassReport{
+		Started:         s.started,
+		Duration:        time.Since(s.started).String(),
+		DryRun:          dryRun,
+		ResourceVersion: s.resourceVersion,
+		Listed:          s.listed,
+		Inspected:       s.inspected,
+		Ready:           s.ready,
+		Running:         s.running,
+		Deleted:         s.deleted,
+		Cordoned:        s.cordoned,
+		Errors:          s.errors,
+		Candidates:      make([]CandidateReport, 0, len(s.candidates)),
+	}
+
+	for _, c := range s.candidates {
+		report.Candidates = append(report.Candidates, CandidateReport{Node: c.node.ObjectMeta.Name, InstanceID: c.instanceID, State: c.state})
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	return report
+}
+
+// Log logs a single line describing how the pass went.
+func (s *summary) Log() {
+	slog.Info("Reconcile finished", "duration", time.Since(s.started), "resource_version", s.resourceVersion, "listed", s.listed, "skipped_ready", s.ready, "skipped_running", s.running, "deleted", s.deleted, "cordoned", s.cordoned, "errors", s.errors)
+}
+
+// LogDeleted logs a single line listing the nodes which were deleted.
+func (s *summary) LogDeleted() {
+	names := append([]string(nil), s.deletedNodes...)
+	sort.Strings(names)
+
+	slog.Info("Deleted nodes", "action", "delete", "count", len(names), "nodes", names)
+}
+
+// LogDryRun logs a rollup of what the pass would have done.
+func (s *summary) LogDryRun() {
+	names := make([]string, 0, len(s.candidates))
+
+	for _, c := range s.candidates {
+		names = append(names, c.node.ObjectMeta.Name+" ("+c.instanceID+")")
+	}
+
+	slog.Info("Dry run summary", "inspected", s.inspected, "ready", s.ready, "running", s.running, "would_delete", names)
+}
@@ -0,0 +1,242 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to wait for the collector to accept a trace.
+	tracingTimeout = 10 * time.Second
+
+	// OTLP span kind and status code values.
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+// Records spans for each reconcile pass and sends them to an OpenTelemetry
+// collector using OTLP's JSON encoding over HTTP, in the background so a
+// slow or broken collector never holds up node cleanup.
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	wg       sync.WaitGroup
+
+	// Spans which have ended, waiting for their root span to end.
+	mu       sync.Mutex
+	finished []otlpSpan
+}
+
+// Helper function to trace reconcile passes, when a collector endpoint has been
+// configured.
+func newTracer(n Notifications) *tracer {
+	return &tracer{
+		endpoint: n.OtelEndpoint,
+		client:   &http.Client{Timeout: tracingTimeout},
+	}
+}
+
+// The key the current span is stored under in a context.
+type spanKey struct{}
+
+// A span which has been started and not yet ended. A nil span is a no-op,
+// which is what we hand out when tracing is disabled.
+type span struct {
+	tracer   *tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	attrs    []otlpAttribute
+}
+
+// Start begins a span as a child of the span in the context, if there is one,
+// with attributes given as key, value pairs. The returned context carries the
+// new span for its children.
+func (t *tracer) Start(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	if t.endpoint == "" {
+		return ctx, nil
+	}
+
+	s := &span{
+		tracer: t,
+		spanID: randomID(8),
+		name:   name,
+		start:  time.Now(),
+	}
+
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.traceID = randomID(16)
+	}
+
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs = append(s.attrs, otlpAttribute{Key: attrs[i], Value: otlpValue{StringValue: attrs[i+1]}})
+	}
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Helper function to start a span as a child of the span in the context, using
+// the same tracer, for code which doesn't have the tracer to hand. Nothing is
+// traced when the context has no span.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	parent, ok := ctx.Value(spanKey{}).(*span)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+
+	return parent.tracer.Start(ctx, name, attrs...)
+}
+
+// End finishes the span, marking it as failed when err is set. Ending a root
+// span sends the whole trace to the collector.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	record := otlpSpan{
+		TraceID:           s.traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+
+	if err != nil {
+		record.Status = otlpStatus{Code: otlpStatusCodeError, Message: err.Error()}
+	}
+
+	t := s.tracer
+
+	t.mu.Lock()
+	t.finished = append(t.finished, record)
+
+	if s.parentID != "" {
+		t.mu.Unlock()
+		return
+	}
+
+	spans := t.finished
+	t.finished = nil
+	t.mu.Unlock()
+
+	t.wg.Add(1)
+
+	go func() {
+		defer t.wg.Done()
+
+		err := t.export(spans)
+		if err != nil {
+			slog.Error("Failed to export trace", "error", err)
+		}
+	}()
+}
+
+// Wait blocks until all traces have been sent.
+func (t *tracer) Wait() {
+	t.wg.Wait()
+}
+
+func (t *tracer) export(spans []otlpSpan) error {
+	service := otlpAttribute{Key: "service.name", Value: otlpValue{StringValue: Component}}
+
+	body, err := json.Marshal(otlpTraces{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{Attributes: []otlpAttribute{service}},
+				ScopeSpans: []otlpScopeSpans{
+					{Scope: otlpScope{Name: Component}, Spans: spans},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(strings.TrimSuffix(t.endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Helper function to generate a random trace or span ID of n bytes.
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// The subset of the OTLP trace export request we send, in its JSON encoding.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
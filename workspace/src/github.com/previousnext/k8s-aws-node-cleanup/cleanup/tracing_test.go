@@ -0,0 +1,65 @@
+package cleanup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracer(t *testing.T) {
+	var requests []otlpTraces
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+
+		var traces otlpTraces
+		json.NewDecoder(r.Body).Decode(&traces)
+		requests = append(requests, traces)
+	}))
+	defer server.Close()
+
+	tr := &tracer{endpoint: server.URL, client: server.Client()}
+
+	ctx, root := tr.Start(context.Background(), "reconcile")
+	// Children pick up the tracer from their parent.
+	_, child := startSpan(ctx, "delete node", "node", "node1")
+	child.End(fmt.Errorf("boom"))
+	root.End(nil)
+	tr.Wait()
+
+	assert.Len(t, requests, 1)
+
+	spans := requests[0].ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+
+	assert.Equal(t, "delete node", spans[0].Name)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, []otlpAttribute{{Key: "node", Value: otlpValue{StringValue: "node1"}}}, spans[0].Attributes)
+	assert.Equal(t, otlpStatus{Code: otlpStatusCodeError, Message: "boom"}, spans[0].Status)
+
+	assert.Equal(t, "reconcile", spans[1].Name)
+	assert.Equal(t, "", spans[1].ParentSpanID)
+	assert.Len(t, spans[1].TraceID, 32)
+	assert.Len(t, spans[1].SpanID, 16)
+	assert.Equal(t, otlpStatus{}, spans[1].Status)
+}
+
+func TestTracerDisabled(t *testing.T) {
+	tr := &tracer{client: http.DefaultClient}
+
+	ctx, span := tr.Start(context.Background(), "reconcile")
+	assert.Nil(t, span)
+	assert.Equal(t, context.Background(), ctx)
+
+	_, child := startSpan(ctx, "delete node")
+	assert.Nil(t, child)
+
+	span.End(nil)
+	tr.Wait()
+}
@@ -0,0 +1,118 @@
+package cleanup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The header carrying the HMAC-SHA256 signature of the body, when a secret is set.
+const webhookSignatureHeader = "X-Signature-256"
+
+// Posts a JSON payload per deleted node to an arbitrary endpoint in the
+// background, so a slow or broken webhook never holds up node cleanup.
+type webhookNotifier struct {
+	url     string
+	secret  string
+	cluster string
+	client  *http.Client
+	wg      sync.WaitGroup
+}
+
+// The payload posted for each deleted node.
+type webhookPayload struct {
+	Cluster    string    `json:"cluster,omitempty"`
+	Node       string    `json:"node"`
+	InstanceID string    `json:"instance_id"`
+	State      string    `json:"state"`
+	Reason     string    `json:"reason"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Helper function to notify a webhook about deleted nodes, when one has been
+// configured.
+func newWebhookNotifier(n Notifications) *webhookNotifier {
+	return &webhookNotifier{
+		url:     n.WebhookURL,
+		secret:  n.WebhookSecret,
+		cluster: n.ClusterName,
+		client:  &http.Client{Timeout: n.WebhookTimeout},
+	}
+}
+
+// NodeDeleted posts a payload about a deleted node.
+func (n *webhookNotifier) NodeDeleted(node, instanceID, state, reason string, now time.Time) {
+	if n.url == "" {
+		return
+	}
+
+	payload := webhookPayload{
+		Cluster:    n.cluster,
+		Node:       node,
+		InstanceID: instanceID,
+		State:      state,
+		Reason:     reason,
+		Timestamp:  now.UTC(),
+	}
+
+	n.wg.Add(1)
+
+	go func() {
+		defer n.wg.Done()
+
+		err := n.post(payload)
+		if err != nil {
+			slog.Error("Failed to post to webhook", "node", node, "instance_id", instanceID, "error", err)
+		}
+	}()
+}
+
+// Wait blocks until all payloads have been posted.
+func (n *webhookNotifier) Wait() {
+	n.wg.Wait()
+}
+
+func (n *webhookNotifier) post(payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	// Let the receiver check the payload really came from us.
+	if n.secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(n.secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Helper function to sign a payload with HMAC-SHA256.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
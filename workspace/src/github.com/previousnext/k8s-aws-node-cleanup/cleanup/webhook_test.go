@@ -0,0 +1,64 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	var payloads []webhookPayload
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		var payload webhookPayload
+		json.Unmarshal(body, &payload)
+		payloads = append(payloads, payload)
+
+		assert.Equal(t, "sha256="+webhookSignature("secret", body), r.Header.Get(webhookSignatureHeader))
+	}))
+	defer server.Close()
+
+	now := time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	n := &webhookNotifier{url: server.URL, secret: "secret", cluster: "prod", client: server.Client()}
+	n.NodeDeleted("node1", "i-123", "terminated", "node is not ready and its instance is terminated", now)
+	n.Wait()
+
+	assert.Equal(t, []webhookPayload{{
+		Cluster:    "prod",
+		Node:       "node1",
+		InstanceID: "i-123",
+		State:      "terminated",
+		Reason:     "node is not ready and its instance is terminated",
+		Timestamp:  now,
+	}}, payloads)
+}
+
+func TestWebhookNotifierUnsigned(t *testing.T) {
+	var signature string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(webhookSignatureHeader)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	n := &webhookNotifier{url: server.URL, client: server.Client()}
+
+	err := n.post(webhookPayload{Node: "node1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", signature)
+}
+
+func TestWebhookNotifierDisabled(t *testing.T) {
+	n := &webhookNotifier{client: http.DefaultClient}
+	n.NodeDeleted("node1", "i-123", "terminated", "instance is terminated", time.Now())
+	n.Wait()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"gopkg.in/yaml.v2"
+)
+
+// Flags which make no sense in a config file.
+var configIgnoredFlags = map[string]bool{
+	"config":  true,
+	"help":    true,
+	"version": true,
+}
+
+// Helper function to find the config file named on the command line or in the
+// environment. It has to be loaded before the rest of the flags are parsed.
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+
+		if path, ok := strings.CutPrefix(arg, "--config="); ok {
+			return path
+		}
+
+		if arg == "--config" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+
+	return os.Getenv("CONFIG")
+}
+
+// Helper function to load a YAML file, whose keys are flag names, as the
+// defaults for those flags. Flags and their environment variables still take
+// precedence over the file.
+func loadConfig(app *kingpin.Application, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	// Report problems in a stable order.
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		flag := app.GetFlag(key)
+		if flag == nil || configIgnoredFlags[key] {
+			return fmt.Errorf("unknown key in %s: %s", path, key)
+		}
+
+		defaults, err := configValues(values[key])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s in %s: %v", key, path, err)
+		}
+
+		flag.Default(defaults...)
+	}
+
+	return nil
+}
+
+// Helper function to convert a config file value into flag values. Lists are
+// used for flags which can be repeated.
+func configValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		var values []string
+
+		for _, item := range v {
+			switch item.(type) {
+			case []interface{}, map[interface{}]interface{}:
+				return nil, fmt.Errorf("lists may only contain plain values")
+			}
+
+			values = append(values, fmt.Sprint(item))
+		}
+
+		return values, nil
+	case map[interface{}]interface{}:
+		return nil, fmt.Errorf("expected a value or a list of values")
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to write a config file for a test.
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(data), 0600)
+	assert.Nil(t, err)
+
+	return path
+}
+
+func TestConfigPath(t *testing.T) {
+	t.Setenv("CONFIG", "")
+
+	assert.Equal(t, "a.yaml", configPath([]string{"--dry", "--config", "a.yaml"}))
+	assert.Equal(t, "b.yaml", configPath([]string{"--config=b.yaml", "--dry"}))
+	assert.Equal(t, "", configPath([]string{"--dry", "--", "--config=c.yaml"}))
+	assert.Equal(t, "", configPath([]string{"--config"}))
+
+	t.Setenv("CONFIG", "d.yaml")
+	assert.Equal(t, "d.yaml", configPath([]string{"--dry"}))
+}
+
+func TestLoadConfig(t *testing.T) {
+	app := kingpin.New("test", "")
+
+	var (
+		frequency = app.Flag("frequency", "").Default("120s").Duration()
+		dry       = app.Flag("dry", "").Bool()
+		region    = app.Flag("region", "").Default("ap-southeast-2").OverrideDefaultFromEnvar("TEST_REGION").String()
+		selector  = app.Flag("selector", "").Default("").String()
+		labels    = app.Flag("protect-label", "").Strings()
+	)
+
+	path := writeConfig(t, `
+frequency: 5m
+dry: true
+region: us-west-2
+selector: role=worker
+protect-label:
+  - keep
+  - pool=system
+`)
+
+	t.Setenv("TEST_REGION", "eu-west-1")
+
+	err := loadConfig(app, path)
+	assert.Nil(t, err)
+
+	// Flags override environment variables, which override the file.
+	_, err = app.Parse([]string{"--selector", "role=spot"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 5*time.Minute, *frequency)
+	assert.True(t, *dry)
+	assert.Equal(t, "eu-west-1", *region)
+	assert.Equal(t, "role=spot", *selector)
+	assert.Equal(t, []string{"keep", "pool=system"}, *labels)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	app := kingpin.New("test", "")
+	app.Flag("frequency", "").Default("120s").Duration()
+	app.Flag("config", "").String()
+
+	tests := map[string]string{
+		"unknown key": "frequncy: 5m\n",
+		"config key":  "config: other.yaml\n",
+		"map value":   "frequency:\n  every: 5m\n",
+		"not yaml":    "frequency: [5m\n",
+	}
+
+	for name, data := range tests {
+		err := loadConfig(app, writeConfig(t, data))
+		assert.NotNil(t, err, name)
+	}
+
+	err := loadConfig(app, filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// How long to wait for recorded events to be written before exiting.
+const eventFlushTimeout = 10 * time.Second
+
+// Writes the events recorded against nodes to the cluster in the background,
+// keeping count so that they can be flushed before the process exits, which
+// with --once is straight after the pass.
+type eventSink struct {
+	sync.Mutex
+	sink     record.EventSink
+	recorded int
+	written  int
+}
+
+// Helper function to build a recorder for events which are written to sink.
+func newEventRecorder(sink record.EventSink, component string) (record.EventRecorder, *eventSink) {
+	events := &eventSink{sink: sink}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartEventWatcher(events.write)
+
+	return &countingRecorder{
+		EventRecorder: broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component}),
+		events:        events,
+	}, events
+}
+
+func (e *eventSink) write(event *v1.Event) {
+	_, err := e.sink.Create(event)
+	if err != nil {
+		slog.Warn("Failed to record event", "object", event.InvolvedObject.Name, "reason", event.Reason, "error", err)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.written++
+}
+
+// Flush waits for the events recorded so far to be written, for up to timeout.
+func (e *eventSink) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		e.Lock()
+		done := e.written >= e.recorded
+		e.Unlock()
+
+		if done {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	slog.Warn("Timed out waiting for events to be recorded", "timeout", timeout)
+}
+
+// Counts an event about object, unless the recorder is going to drop it
+// because it can't be referenced or has an unknown type.
+func (e *eventSink) add(object runtime.Object, eventtype string) {
+	if _, err := v1.GetReference(scheme.Scheme, object); err != nil {
+		return
+	}
+
+	if eventtype != v1.EventTypeNormal && eventtype != v1.EventTypeWarning {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.recorded++
+}
+
+// Counts the events recorded, so the sink knows how many to wait for.
+type countingRecorder struct {
+	record.EventRecorder
+	events *eventSink
+}
+
+func (c *countingRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	c.events.add(object, eventtype)
+	c.EventRecorder.Event(object, eventtype, reason, message)
+}
+
+func (c *countingRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	c.events.add(object, eventtype)
+	c.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func (c *countingRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	c.events.add(object, eventtype)
+	c.EventRecorder.PastEventf(object, timestamp, eventtype, reason, messageFmt, args...)
+}
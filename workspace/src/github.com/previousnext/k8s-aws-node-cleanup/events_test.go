@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	core "k8s.io/client-go/testing"
+)
+
+func TestEventRecorderFlush(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	recorder, events := newEventRecorder(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")}, "test")
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", SelfLink: "/api/v1/nodes/node1"}}
+
+	recorder.Event(node, v1.EventTypeNormal, "NodeCleanup", "Deleted node")
+	recorder.Eventf(node, v1.EventTypeNormal, "NodeCleanup", "Deleted node %s", "again")
+
+	// Everything recorded is in the cluster once the flush returns.
+	events.Flush(time.Minute)
+
+	var created []string
+	for _, action := range clientset.Actions() {
+		if action.Matches("create", "events") {
+			created = append(created, action.(core.CreateAction).GetObject().(*v1.Event).Message)
+		}
+	}
+	sort.Strings(created)
+	assert.Equal(t, []string{"Deleted node", "Deleted node again"}, created)
+
+	// Events the recorder drops aren't waited for.
+	recorder.Event(&v1.Node{}, v1.EventTypeNormal, "NodeCleanup", "Deleted node")
+	recorder.Event(node, "Unknown", "NodeCleanup", "Deleted node")
+
+	start := time.Now()
+	events.Flush(time.Minute)
+	assert.True(t, time.Since(start) < time.Second)
+}
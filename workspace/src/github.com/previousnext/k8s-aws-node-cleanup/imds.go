@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Where the EC2 instance metadata service listens.
+	imdsEndpoint = "http://169.254.169.254"
+
+	// How long to wait for each metadata request.
+	imdsTimeout = 5 * time.Second
+
+	// How long the IMDSv2 session tokens we request are valid for.
+	imdsTokenTTL = 60 * time.Second
+
+	// How to talk to the metadata service. Auto uses an IMDSv2 session token
+	// when one can be had, and falls back to IMDSv1 otherwise.
+	imdsVersionAuto = "auto"
+	imdsVersionV1   = "v1"
+	imdsVersionV2   = "v2"
+)
+
+// Looks up details about the instance we are running on. The metadata client
+// in this version of aws-sdk-go predates IMDSv2, so instances which require
+// session tokens are talked to by hand.
+type imdsClient struct {
+	endpoint string
+	version  string
+	client   *http.Client
+}
+
+// Helper function to build a client for the metadata service on this instance.
+func newIMDSClient(version string) *imdsClient {
+	return &imdsClient{
+		endpoint: imdsEndpoint,
+		version:  version,
+		client:   &http.Client{Timeout: imdsTimeout},
+	}
+}
+
+// Region looks up the region the instance is running in.
+func (c *imdsClient) Region() (string, error) {
+	body, err := c.get("/latest/dynamic/instance-identity/document")
+	if err != nil {
+		return "", fmt.Errorf("failed to reach EC2 metadata at %s, set --region when not running on EC2: %v", c.endpoint, err)
+	}
+
+	var document struct {
+		Region string `json:"region"`
+	}
+
+	err = json.Unmarshal(body, &document)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse instance identity document: %v", err)
+	}
+
+	return document.Region, nil
+}
+
+// Helper function to fetch a metadata path, with a session token when we are
+// using IMDSv2.
+func (c *imdsClient) get(path string) ([]byte, error) {
+	var token string
+
+	if c.version != imdsVersionV1 {
+		var err error
+
+		token, err = c.token()
+		if err != nil && c.version == imdsVersionV2 {
+			return nil, fmt.Errorf("failed to get IMDSv2 token: %v", err)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// Helper function to request an IMDSv2 session token.
+func (c *imdsClient) token() (string, error) {
+	req, err := http.NewRequest(http.MethodPut, c.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(imdsTokenTTL.Seconds())))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	token, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
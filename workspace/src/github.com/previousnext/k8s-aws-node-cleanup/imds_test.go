@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to fake the metadata service, requiring a session token
+// when v2Only is set.
+func fakeIMDS(t *testing.T, v2Only, v2Supported bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			if !v2Supported {
+				http.NotFound(w, r)
+				return
+			}
+
+			assert.Equal(t, "60", r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+			fmt.Fprint(w, "token")
+		case r.Method == http.MethodGet && r.URL.Path == "/latest/dynamic/instance-identity/document":
+			if v2Only && r.Header.Get("X-aws-ec2-metadata-token") != "token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			fmt.Fprint(w, `{"region":"ap-southeast-2","instanceId":"i-123"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestIMDSClientRegion(t *testing.T) {
+	tests := []struct {
+		version     string
+		v2Only      bool
+		v2Supported bool
+		err         bool
+	}{
+		{version: imdsVersionAuto, v2Only: true, v2Supported: true},
+		{version: imdsVersionAuto, v2Supported: false},
+		{version: imdsVersionV2, v2Only: true, v2Supported: true},
+		{version: imdsVersionV2, v2Supported: false, err: true},
+		{version: imdsVersionV1},
+		{version: imdsVersionV1, v2Only: true, v2Supported: true, err: true},
+	}
+
+	for _, test := range tests {
+		server := fakeIMDS(t, test.v2Only, test.v2Supported)
+
+		c := &imdsClient{endpoint: server.URL, version: test.version, client: server.Client()}
+
+		region, err := c.Region()
+		if test.err {
+			assert.NotNil(t, err, test)
+		} else {
+			assert.Nil(t, err, test)
+			assert.Equal(t, "ap-southeast-2", region, test)
+		}
+
+		server.Close()
+	}
+}
+
+func TestIMDSClientUnreachable(t *testing.T) {
+	server := fakeIMDS(t, false, false)
+	server.Close()
+
+	c := &imdsClient{endpoint: server.URL, version: imdsVersionAuto, client: server.Client()}
+
+	_, err := c.Region()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to reach EC2 metadata")
+}
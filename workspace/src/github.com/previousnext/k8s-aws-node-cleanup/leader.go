@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// The annotation holding the leader record, the same one client-go's
+	// leaderelection package uses for its ConfigMap lock.
+	annotationLeader = "control-plane.alpha.kubernetes.io/leader"
+
+	// How long a leader holds the lock without renewing it before standbys take over.
+	leaseDuration = 15 * time.Second
+
+	// How long the leader keeps trying to renew before it gives up.
+	renewDeadline = 10 * time.Second
+
+	// How often to try to acquire or renew the lock.
+	retryPeriod = 2 * time.Second
+)
+
+// Returned when we stop being the leader, so that the process can restart as a standby.
+var errLostLeadership = errors.New("lost leadership")
+
+// The record stored on the lock, compatible with client-go's LeaderElectionRecord.
+type leaderRecord struct {
+	HolderIdentity       string      `json:"holderIdentity"`
+	LeaseDurationSeconds int         `json:"leaseDurationSeconds"`
+	AcquireTime          metav1.Time `json:"acquireTime"`
+	RenewTime            metav1.Time `json:"renewTime"`
+	LeaderTransitions    int         `json:"leaderTransitions"`
+}
+
+// Elects a single leader between replicas using an annotation on a ConfigMap,
+// relying on resourceVersion conflicts to settle races.
+type leaderElector struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	identity  string
+
+	// An unparseable leader record we found on the lock, and when we first saw it.
+	corruptRecord string
+	corruptSince  time.Time
+}
+
+// Run blocks until we become the leader, then calls fn with a context which is
+// cancelled if we stop being the leader. Returns nil once ctx is cancelled, or
+// errLostLeadership if we failed to renew the lock in time.
+func (l *leaderElector) Run(ctx context.Context, fn func(context.Context) error) error {
+	logger := slog.With("lock", l.namespace+"/"+l.name, "identity", l.identity)
+
+	logger.Info("Waiting to become the leader")
+
+	for !l.tryAcquireOrRenew(time.Now()) {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retryPeriod):
+		}
+	}
+
+	logger.Info("Became the leader")
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- fn(leaderCtx)
+	}()
+
+	renewed := time.Now()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(retryPeriod):
+		}
+
+		if l.tryAcquireOrRenew(time.Now()) {
+			renewed = time.Now()
+			continue
+		}
+
+		if time.Since(renewed) > renewDeadline {
+			logger.Error("Failed to renew leadership, stopping")
+			cancel()
+			<-done
+			return errLostLeadership
+		}
+	}
+}
+
+// Attempts to take or renew the lock, returning true if we hold it.
+func (l *leaderElector) tryAcquireOrRenew(now time.Time) bool {
+	record := leaderRecord{
+		HolderIdentity:       l.identity,
+		LeaseDurationSeconds: int(leaseDuration / time.Second),
+		AcquireTime:          metav1.NewTime(now),
+		RenewTime:            metav1.NewTime(now),
+	}
+
+	configMaps := l.clientset.CoreV1().ConfigMaps(l.namespace)
+
+	lock, err := configMaps.Get(l.name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		lock = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      l.name,
+				Namespace: l.namespace,
+			},
+		}
+
+		if err := setLeaderRecord(lock, record); err != nil {
+			return false
+		}
+
+		_, err = configMaps.Create(lock)
+		return err == nil
+	}
+
+	if err != nil {
+		slog.Error("Failed to get leader lock", "error", err)
+		return false
+	}
+
+	var existing leaderRecord
+
+	if raw, ok := lock.ObjectMeta.Annotations[annotationLeader]; ok {
+		err := json.Unmarshal([]byte(raw), &existing)
+		if err != nil {
+			// We can't tell who holds the lock or when they last renewed it, so
+			// treat it as held for a lease from when we first saw the record.
+			if raw != l.corruptRecord {
+				slog.Error("Failed to parse leader record, treating the lock as held until it expires", "error", err)
+				l.corruptRecord = raw
+				l.corruptSince = now
+			}
+
+			existing = leaderRecord{
+				HolderIdentity:       "unknown",
+				LeaseDurationSeconds: int(leaseDuration / time.Second),
+				RenewTime:            metav1.NewTime(l.corruptSince),
+			}
+		}
+	}
+
+	expires := existing.RenewTime.Add(time.Duration(existing.LeaseDurationSeconds) * time.Second)
+
+	// Somebody else holds a lease which hasn't expired.
+	if existing.HolderIdentity != "" && existing.HolderIdentity != l.identity && now.Before(expires) {
+		return false
+	}
+
+	if existing.HolderIdentity == l.identity {
+		record.AcquireTime = existing.AcquireTime
+		record.LeaderTransitions = existing.LeaderTransitions
+	} else {
+		record.LeaderTransitions = existing.LeaderTransitions + 1
+	}
+
+	if err := setLeaderRecord(lock, record); err != nil {
+		return false
+	}
+
+	// Fails with a conflict if somebody else updated the lock since we read it.
+	_, err = configMaps.Update(lock)
+	return err == nil
+}
+
+// Helper function to store a leader record on the lock.
+func setLeaderRecord(lock *v1.ConfigMap, record leaderRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if lock.ObjectMeta.Annotations == nil {
+		lock.ObjectMeta.Annotations = make(map[string]string)
+	}
+
+	lock.ObjectMeta.Annotations[annotationLeader] = string(raw)
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestLeaderElector(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	first := &leaderElector{clientset: clientset, namespace: "kube-system", name: "lock", identity: "first"}
+	second := &leaderElector{clientset: clientset, namespace: "kube-system", name: "lock", identity: "second"}
+
+	now := time.Now()
+
+	// The first replica creates the lock and keeps renewing it.
+	assert.True(t, first.tryAcquireOrRenew(now))
+	assert.True(t, first.tryAcquireOrRenew(now.Add(time.Second)))
+
+	// The second replica has to wait while the lease is current.
+	assert.False(t, second.tryAcquireOrRenew(now.Add(5*time.Second)))
+
+	// Once the lease expires the second replica takes over.
+	assert.True(t, second.tryAcquireOrRenew(now.Add(time.Second+leaseDuration+time.Second)))
+	assert.False(t, first.tryAcquireOrRenew(now.Add(time.Second+leaseDuration+2*time.Second)))
+}
+
+func TestLeaderElectorCorruptRecord(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "lock",
+			Namespace:   "kube-system",
+			Annotations: map[string]string{annotationLeader: "not a record"},
+		},
+	})
+
+	elector := &leaderElector{clientset: clientset, namespace: "kube-system", name: "lock", identity: "first"}
+
+	now := time.Now()
+
+	// Whoever wrote the record might still hold the lock, so wait out a lease
+	// from when we first saw it.
+	assert.False(t, elector.tryAcquireOrRenew(now))
+	assert.False(t, elector.tryAcquireOrRenew(now.Add(5*time.Second)))
+
+	assert.True(t, elector.tryAcquireOrRenew(now.Add(leaseDuration+time.Second)))
+	assert.True(t, elector.tryAcquireOrRenew(now.Add(leaseDuration+2*time.Second)))
+}
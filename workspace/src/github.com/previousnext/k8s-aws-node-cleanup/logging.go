@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+// Formats which logs can be written in.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Helper function to build a structured logger which writes in the given
+// format, skipping anything below the given level.
+func newLogger(w io.Writer, format, level string) *slog.Logger {
+	var lvl slog.Level
+
+	// The level has already been validated by the flag parser.
+	lvl.UnmarshalText([]byte(level))
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+
+	return slog.New(slog.NewTextHandler(w, opts))
+}
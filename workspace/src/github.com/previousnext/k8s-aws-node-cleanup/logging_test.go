@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := newLogger(&buf, logFormatJSON, "info")
+	logger.Debug("Hidden")
+	logger.Info("Node is ready, skipping", "node", "node1", "instance_id", "i-123", "action", "skip")
+
+	var line map[string]interface{}
+
+	err := json.Unmarshal(buf.Bytes(), &line)
+	assert.Nil(t, err)
+	assert.Equal(t, "Node is ready, skipping", line["msg"])
+	assert.Equal(t, "node1", line["node"])
+	assert.Equal(t, "i-123", line["instance_id"])
+	assert.Equal(t, "skip", line["action"])
+}
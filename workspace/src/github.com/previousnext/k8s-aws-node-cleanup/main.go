@@ -1,144 +1,630 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/previousnext/k8s-aws-node-cleanup/cleanup"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/api/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// The region used when a custom EC2 endpoint is set without one.
+	defaultEndpointRegion = "us-east-1"
+
+	// Exit codes, so a CronJob running --once can tell a pass which couldn't
+	// run at all from one which left some nodes behind.
+	exitFatal   = 1
+	exitPartial = 2
+
+	// The shortest frequency allowed without --min-frequency-override.
+	minFrequency = 5 * time.Second
+)
+
+// Build information, injected at build time with -ldflags -X.
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
 )
 
 var (
-	cliFrequency = kingpin.Flag("frequency", "How frequently to check for nodes to cleanup").Default("120s").OverrideDefaultFromEnvar("FREQUENCY").Duration()
-	cliDryRun    = kingpin.Flag("dry", "Only log, don't delete nodes").Bool()
+	cliConfig               = kingpin.Flag("config", "YAML file of flag values, keyed by flag name, which flags and environment variables override").Default("").OverrideDefaultFromEnvar("CONFIG").String()
+	cliFrequency            = kingpin.Flag("frequency", "How frequently to check for nodes to cleanup").Default("120s").OverrideDefaultFromEnvar("FREQUENCY").Duration()
+	cliMinFrequencyOK       = kingpin.Flag("min-frequency-override", "Allow a --frequency shorter than "+minFrequency.String()).Default("false").OverrideDefaultFromEnvar("MIN_FREQUENCY_OVERRIDE").Bool()
+	cliFrequencyMaxBackoff  = kingpin.Flag("frequency-max-backoff", "Slow down to at most this interval while listing nodes or describing instances is failing, disabled when 0").Default("0").OverrideDefaultFromEnvar("FREQUENCY_MAX_BACKOFF").Duration()
+	cliJitter               = kingpin.Flag("jitter", "Fraction of the frequency to randomly adjust each interval by").Default("0.1").OverrideDefaultFromEnvar("JITTER").Float()
+	cliErrorRequeue         = kingpin.Flag("error-requeue", "How soon to take another look at nodes which hit an error during a pass, disabled when zero").Default("0s").OverrideDefaultFromEnvar("ERROR_REQUEUE").Duration()
+	cliOnce                 = kingpin.Flag("once", "Perform a single cleanup pass and exit: 0 after a clean pass, 2 if some nodes could not be inspected or deleted, 1 if the pass could not run").Bool()
+	cliRequireTag           = kingpin.Flag("require-tag", "Only delete nodes whose instance carries this key=value tag").Default("").OverrideDefaultFromEnvar("REQUIRE_TAG").String()
+	cliInstanceTagFilter    = kingpin.Flag("instance-tag-filter", "Describe the instances carrying this key=value tag instead of each node's instance, treating nodes whose instance isn't among them as gone. Can't be used with --require-tag").Default("").OverrideDefaultFromEnvar("INSTANCE_TAG_FILTER").String()
+	cliRequireEmpty         = kingpin.Flag("require-empty", "Only delete nodes with no pods scheduled, other than DaemonSet, mirror, finished and terminating pods").Default("false").OverrideDefaultFromEnvar("REQUIRE_EMPTY").Bool()
+	cliDryRun               = kingpin.Flag("dry", "Only log, don't delete nodes").Bool()
+	cliConfirmations        = kingpin.Flag("confirmations", "How many consecutive passes a node must fail before it is deleted, always 1 with --once").Default("2").OverrideDefaultFromEnvar("CONFIRMATIONS").Int()
+	cliAnnotateThenWait     = kingpin.Flag("annotate-then-wait", "Annotate nodes with "+cleanup.AnnotationPendingDelete+" the first time they qualify for deletion, and only delete them once they still qualify after --pending-delete-wait. The annotation is removed if they recover").Default("false").OverrideDefaultFromEnvar("ANNOTATE_THEN_WAIT").Bool()
+	cliPendingDeleteWait    = kingpin.Flag("pending-delete-wait", "How long nodes must have been annotated as pending deletion before --annotate-then-wait deletes them").Default("10m").OverrideDefaultFromEnvar("PENDING_DELETE_WAIT").Duration()
+	cliSelector             = kingpin.Flag("selector", "Only consider nodes matching this label selector, all nodes when empty").OverrideDefaultFromEnvar("SELECTOR").String()
+	cliListPageSize         = kingpin.Flag("list-page-size", "List nodes in pages of this size, all at once when 0").Default("0").OverrideDefaultFromEnvar("LIST_PAGE_SIZE").Int64()
+	cliNodeAgeMax           = kingpin.Flag("node-age-max", "Delete not ready nodes older than this even when their instance can't be looked up, disabled when zero").Default("0s").OverrideDefaultFromEnvar("NODE_AGE_MAX").Duration()
+	cliNotFoundGrace        = kingpin.Flag("instance-not-found-grace", "How long AWS must have consistently reported a node's instance as not found before the node is deleted, disabled when zero").Default("0s").OverrideDefaultFromEnvar("INSTANCE_NOT_FOUND_GRACE").Duration()
+	cliNotReadyGrace        = kingpin.Flag("notready-grace", "How long a node must have been not ready before it is considered for cleanup").Default("0").OverrideDefaultFromEnvar("NOTREADY_GRACE").Duration()
+	cliSkipInstanceCheck    = kingpin.Flag("skip-instance-check", "Delete nodes which have been not ready for longer than --notready-grace without looking up their instances, for clusters without EC2 access").Default("false").OverrideDefaultFromEnvar("SKIP_INSTANCE_CHECK").Bool()
+	cliRequireConditions    = kingpin.Flag("require-conditions", "Comma separated node conditions which must be healthy, as well as Ready, for a node to be left alone, as type or type=status. Pressure conditions and NetworkUnavailable are healthy when False, others when True, unless the status is given. Conditions a node doesn't report are ignored").Default("").OverrideDefaultFromEnvar("REQUIRE_CONDITIONS").String()
+	cliHeartbeatGrace       = kingpin.Flag("heartbeat-grace", "Never delete nodes whose kubelet has posted a heartbeat within this long").Default("0").OverrideDefaultFromEnvar("HEARTBEAT_GRACE").Duration()
+	cliNodeNameFilter       = kingpin.Flag("node-name-filter", "Only clean up nodes with names matching this regular expression").Default("").OverrideDefaultFromEnvar("NODE_NAME_FILTER").String()
+	cliProtectLabels        = kingpin.Flag("protect-label", "Never delete nodes with this label, as key or key=value (repeatable)").Strings()
+	cliMinAge               = kingpin.Flag("min-age", "Minimum age of a node before it is considered for cleanup").Default("5m").OverrideDefaultFromEnvar("MIN_AGE").Duration()
+	cliDeletableStates      = kingpin.Flag("deletable-states", "Comma separated instance states which allow a node to be deleted").Default("terminated,shutting-down").OverrideDefaultFromEnvar("DELETABLE_STATES").String()
+	cliConcurrency          = kingpin.Flag("concurrency", "How many AWS and Kubernetes calls to make in parallel").Default("5").OverrideDefaultFromEnvar("CONCURRENCY").Int()
+	cliMaxRetries           = kingpin.Flag("max-retries", "How many times to retry throttled or failed AWS calls, 0 to never retry").Default("5").OverrideDefaultFromEnvar("MAX_RETRIES").Int()
+	cliProtectTaints        = kingpin.Flag("protect-taint", "Never delete nodes with this taint, as key[=value][:effect] (repeatable)").Strings()
+	cliSkipAnnotation       = kingpin.Flag("skip-annotation", "Never delete nodes with this annotation set to \"true\"").Default("k8s-aws-cleanup/skip").OverrideDefaultFromEnvar("SKIP_ANNOTATION").String()
+	cliMaxDeletions         = kingpin.Flag("max-deletions", "Maximum number of nodes to delete in a single pass, 0 for unlimited").Default("0").OverrideDefaultFromEnvar("MAX_DELETIONS").Int()
+	cliDeleteRate           = kingpin.Flag("delete-rate", "Maximum number of nodes to delete a minute across passes, deferring the rest to later passes, 0 for unlimited").Default("0").OverrideDefaultFromEnvar("DELETE_RATE").Float()
+	cliMaxDeletionFraction  = kingpin.Flag("max-deletion-fraction", "Delete nothing if more than this fraction of nodes are candidates, 0 to disable").Default("0").OverrideDefaultFromEnvar("MAX_DELETION_FRACTION").Float()
+	cliMinExpectedNodes     = kingpin.Flag("min-expected-nodes", "Skip passes which list fewer nodes than this, in case the apiserver is returning a degraded view of the cluster").Default("0").OverrideDefaultFromEnvar("MIN_EXPECTED_NODES").Int()
+	cliAssumeRoleARN        = kingpin.Flag("assume-role-arn", "IAM role to assume when querying EC2, for instances in another account").OverrideDefaultFromEnvar("ASSUME_ROLE_ARN").String()
+	cliAssumeRoleExternalID = kingpin.Flag("assume-role-external-id", "External ID to pass when assuming the IAM role").OverrideDefaultFromEnvar("ASSUME_ROLE_EXTERNAL_ID").String()
+	cliAWSProfile           = kingpin.Flag("aws-profile", "Profile to read static AWS credentials from in --aws-credentials-file, instead of the default credential chain").Default("").OverrideDefaultFromEnvar("AWS_PROFILE").String()
+	cliAWSCredentialsFile   = kingpin.Flag("aws-credentials-file", "Shared credentials file, such as a mounted secret, to read static AWS credentials from instead of the default credential chain").Default("").OverrideDefaultFromEnvar("AWS_SHARED_CREDENTIALS_FILE").String()
+	cliPartition            = kingpin.Flag("partition", "AWS partition the regions are in, such as aws-cn or aws-us-gov, worked out from the region when empty").Default("").OverrideDefaultFromEnvar("AWS_PARTITION").String()
+	cliEC2Endpoint          = kingpin.Flag("ec2-endpoint", "Custom EC2 API endpoint, such as LocalStack for testing").Default("").OverrideDefaultFromEnvar("EC2_ENDPOINT").String()
+	cliCheckASGLifecycle    = kingpin.Flag("check-asg-lifecycle", "Also delete nodes whose instance is being terminated by its Auto Scaling group").Default("false").OverrideDefaultFromEnvar("CHECK_ASG_LIFECYCLE").Bool()
+	cliRespectProtection    = kingpin.Flag("respect-termination-protection", "Never delete nodes whose instance has termination or scale in protection").Default("false").OverrideDefaultFromEnvar("RESPECT_TERMINATION_PROTECTION").Bool()
+	cliRegions              = kingpin.Flag("regions", "Comma separated AWS regions to look up instances in, defaults to --region").Default("").OverrideDefaultFromEnvar("AWS_REGIONS").String()
+	cliIMDSVersion          = kingpin.Flag("imds-version", "How to look up the region from EC2 metadata: auto uses IMDSv2 when available, v2 requires it").Default(imdsVersionAuto).OverrideDefaultFromEnvar("IMDS_VERSION").Enum(imdsVersionAuto, imdsVersionV1, imdsVersionV2)
+	cliRegion               = kingpin.Flag("region", "AWS region, looked up from EC2 metadata when empty").OverrideDefaultFromEnvar("AWS_REGION").String()
+	cliMetricsAddr          = kingpin.Flag("metrics-addr", "Address to serve Prometheus metrics on").Default(":9090").OverrideDefaultFromEnvar("METRICS_ADDR").String()
+	cliDescribeStatus       = kingpin.Flag("describe-instance-status", "Look up instance states with DescribeInstanceStatus, which returns about a seventh of the data DescribeInstances does. Lookups by --instance-tag-filter still use DescribeInstances").Default("false").OverrideDefaultFromEnvar("DESCRIBE_INSTANCE_STATUS").Bool()
+	cliSkipTransitional     = kingpin.Flag("skip-transitional", "Leave nodes alone while their instance is pending, stopping or shutting-down, only deleting them once it is terminated or gone").Default("false").OverrideDefaultFromEnvar("SKIP_TRANSITIONAL").Bool()
+	cliTerminateStopped     = kingpin.Flag("terminate-stopped", "Terminate stopped instances and delete their nodes, instead of leaving them").Default("false").OverrideDefaultFromEnvar("TERMINATE_STOPPED").Bool()
+	cliPreDeleteExec        = kingpin.Flag("pre-delete-exec", "Executable to run with the node name and instance ID before deleting each node, the node is kept if it fails").Default("").OverrideDefaultFromEnvar("PRE_DELETE_EXEC").String()
+	cliPreDeleteTimeout     = kingpin.Flag("pre-delete-timeout", "How long to give --pre-delete-exec before treating it as failed").Default("30s").OverrideDefaultFromEnvar("PRE_DELETE_TIMEOUT").Duration()
+	cliCordonOnly           = kingpin.Flag("cordon-only", "Cordon nodes and label them "+cleanup.LabelCandidate+"=true, for someone to review and delete, instead of draining and deleting them").Default("false").OverrideDefaultFromEnvar("CORDON_ONLY").Bool()
+	cliDrain                = kingpin.Flag("drain", "Cordon and evict pods from nodes before deleting them").Bool()
+	cliDrainTimeout         = kingpin.Flag("drain-timeout", "How long to wait for PodDisruptionBudgets to allow evictions").Default("5m").OverrideDefaultFromEnvar("DRAIN_TIMEOUT").Duration()
+	cliDrainForce           = kingpin.Flag("drain-force", "Delete nodes anyway when the drain timeout is reached").Bool()
+	cliDeleteGracePeriod    = kingpin.Flag("delete-grace-period", "Grace period in seconds to delete nodes with, the API server default when negative").Default("-1").OverrideDefaultFromEnvar("DELETE_GRACE_PERIOD").Int64()
+	cliDeletePropagation    = kingpin.Flag("delete-propagation", "Propagation policy to delete nodes with, the API server default when empty").Default("").OverrideDefaultFromEnvar("DELETE_PROPAGATION").Enum("", string(metav1.DeletePropagationBackground), string(metav1.DeletePropagationForeground), string(metav1.DeletePropagationOrphan))
+	cliDeleteCooldown       = kingpin.Flag("delete-cooldown", "How long to skip a node for after deleting it, while finalizers may keep it around, disabled when zero").Default("5m").OverrideDefaultFromEnvar("DELETE_COOLDOWN").Duration()
+	cliDeleteRetries        = kingpin.Flag("delete-retries", "How many times to retry deleting a node while the Kubernetes API server is throttling requests, honouring Retry-After").Default("3").OverrideDefaultFromEnvar("DELETE_RETRIES").Int()
+	cliMaxDeleteFailures    = kingpin.Flag("delete-failure-threshold", "Log an error and count a stuck deletion once a node has failed to delete this many times in a row, disabled when zero").Default("3").OverrideDefaultFromEnvar("DELETE_FAILURE_THRESHOLD").Int()
+	cliPushgatewayURL       = kingpin.Flag("pushgateway-url", "Push a last_success_timestamp metric to this Prometheus Pushgateway after each successful pass").Default("").OverrideDefaultFromEnvar("PUSHGATEWAY_URL").String()
+	cliOtelEndpoint         = kingpin.Flag("otel-endpoint", "OpenTelemetry collector to send traces of each pass to over OTLP/HTTP, disabled when empty").Default("").OverrideDefaultFromEnvar("OTEL_ENDPOINT").String()
+	cliLogFormat            = kingpin.Flag("log-format", "Format to write logs in").Default("text").OverrideDefaultFromEnvar("LOG_FORMAT").Enum(logFormatText, logFormatJSON)
+	cliQuiet                = kingpin.Flag("quiet", "Log routine skips, such as of ready and running nodes, at debug level").Default("false").OverrideDefaultFromEnvar("QUIET").Bool()
+	cliAuditLog             = kingpin.Flag("audit-log", "File to append a JSON line to for every node deleted (or with --dry-run, which would have been), disabled when empty").Default("").OverrideDefaultFromEnvar("AUDIT_LOG").String()
+	cliAuditLogMaxSize      = kingpin.Flag("audit-log-max-size", "Rotate the audit log to a single backup once it reaches this size, such as 100MB, disabled when zero").Default("0").OverrideDefaultFromEnvar("AUDIT_LOG_MAX_SIZE").Bytes()
+	cliReportFile           = kingpin.Flag("report-file", "File to write the nodes each pass will delete (or with --dry-run, would have) to as JSON, overwritten each pass, disabled when empty").Default("").OverrideDefaultFromEnvar("REPORT_FILE").String()
+	cliSummarizeDeletions   = kingpin.Flag("summarize-deletions", "Log a single line listing the nodes deleted by each pass, with the details of each deletion at debug level").Default("false").OverrideDefaultFromEnvar("SUMMARIZE_DELETIONS").Bool()
+	cliLogLevel             = kingpin.Flag("log-level", "Minimum level of logs to write").Default("info").OverrideDefaultFromEnvar("LOG_LEVEL").Enum("debug", "info", "warn", "error")
+	cliTriggerToken         = kingpin.Flag("trigger-token", "Serve POST /reconcile on the health server, to run a pass on demand for callers with this bearer token, disabled when empty").Default("").OverrideDefaultFromEnvar("TRIGGER_TOKEN").String()
+	cliTLSCert              = kingpin.Flag("tls-cert", "Certificate to serve the metrics and health endpoints over HTTPS with").Default("").OverrideDefaultFromEnvar("TLS_CERT").String()
+	cliTLSKey               = kingpin.Flag("tls-key", "Private key for --tls-cert").Default("").OverrideDefaultFromEnvar("TLS_KEY").String()
+	cliMetricsAuthToken     = kingpin.Flag("metrics-auth-token", "Only serve /metrics to scrapers with this bearer token").Default("").OverrideDefaultFromEnvar("METRICS_AUTH_TOKEN").String()
+	cliHealthAddr           = kingpin.Flag("health-addr", "Address to serve /healthz, /readyz and /status on").Default(":8080").OverrideDefaultFromEnvar("HEALTH_ADDR").String()
+	cliRequestTimeout       = kingpin.Flag("request-timeout", "How long to wait for each AWS and Kubernetes API call").Default("30s").OverrideDefaultFromEnvar("REQUEST_TIMEOUT").Duration()
+	cliSlackWebhook         = kingpin.Flag("slack-webhook", "Slack incoming webhook URL to notify when nodes are deleted").OverrideDefaultFromEnvar("SLACK_WEBHOOK").String()
+	cliWebhookURL           = kingpin.Flag("webhook-url", "POST a JSON payload about each deleted node to this URL").Default("").OverrideDefaultFromEnvar("WEBHOOK_URL").String()
+	cliWebhookTimeout       = kingpin.Flag("webhook-timeout", "How long to wait for the webhook to accept each payload").Default("10s").OverrideDefaultFromEnvar("WEBHOOK_TIMEOUT").Duration()
+	cliWebhookSecret        = kingpin.Flag("webhook-secret", "Sign webhook payloads with HMAC-SHA256 using this secret, in the X-Signature-256 header").Default("").OverrideDefaultFromEnvar("WEBHOOK_SECRET").String()
+	cliClusterName          = kingpin.Flag("cluster-name", "Name of the cluster, included in webhook payloads. When set, only nodes whose instance is tagged kubernetes.io/cluster/<name>=owned are deleted").Default("").OverrideDefaultFromEnvar("CLUSTER_NAME").String()
+	cliLeaderElect          = kingpin.Flag("leader-elect", "Only run the cleanup loop on the elected leader of multiple replicas").Bool()
+	cliLeaderElectName      = kingpin.Flag("leader-elect-name", "Name of the ConfigMap used as the leader election lock").Default(cleanup.Component).OverrideDefaultFromEnvar("LEADER_ELECT_NAME").String()
+	cliLeaderElectNamespace = kingpin.Flag("leader-elect-namespace", "Namespace of the ConfigMap used as the leader election lock").Default("kube-system").OverrideDefaultFromEnvar("LEADER_ELECT_NAMESPACE").String()
+	cliPprofAddr            = kingpin.Flag("pprof-addr", "Address to serve pprof profiling endpoints on, disabled when empty").OverrideDefaultFromEnvar("PPROF_ADDR").String()
+	cliKubeconfig           = kingpin.Flag("kubeconfig", "Path to a kubeconfig file, in-cluster config is used when empty").OverrideDefaultFromEnvar("KUBECONFIG").String()
 )
 
 func main() {
+	kingpin.Version(versionString())
+
+	if path := configPath(os.Args[1:]); path != "" {
+		kingpin.FatalIfError(loadConfig(kingpin.CommandLine, path), "failed to load config")
+	}
+
 	kingpin.Parse()
 
-	meta := ec2metadata.New(session.New(), &aws.Config{})
-	region, err := meta.Region()
+	slog.SetDefault(newLogger(os.Stderr, *cliLogFormat, *cliLogLevel))
+	slog.Info("Starting " + versionString())
+
+	if *cliConfig != "" {
+		slog.Info("Loaded config", "path", *cliConfig)
+	}
+
+	if err := run(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(exitCode(err))
+	}
+}
+
+// Helper function to pick the exit code for an error which stopped us: exitPartial
+// when a pass completed with errors for some nodes, otherwise exitFatal.
+func exitCode(err error) int {
+	if cleanup.IsPartial(err) {
+		return exitPartial
+	}
+
+	return exitFatal
+}
+
+// Helper function to describe which build is running.
+func versionString() string {
+	return fmt.Sprintf("%s %s (commit %s, built %s)", cleanup.Component, version, commit, date)
+}
+
+// Sets up the AWS and Kubernetes clients and runs the cleanup loop until we
+// are asked to shut down.
+func run() error {
+	var err error
+
+	opts := cleanup.Options{
+		Frequency:           *cliFrequency,
+		FrequencyMaxBackoff: *cliFrequencyMaxBackoff,
+		Jitter:              *cliJitter,
+		ErrorRequeue:        *cliErrorRequeue,
+		Selector:            *cliSelector,
+		ListPageSize:        *cliListPageSize,
+		ProtectLabels:       *cliProtectLabels,
+		SkipAnnotation:      *cliSkipAnnotation,
+		MinAge:              *cliMinAge,
+		NotReadyGrace:       *cliNotReadyGrace,
+		NodeAgeMax:          *cliNodeAgeMax,
+		NotFoundGrace:       *cliNotFoundGrace,
+		HeartbeatGrace:      *cliHeartbeatGrace,
+		SkipInstanceCheck:   *cliSkipInstanceCheck,
+		CheckASGLifecycle:   *cliCheckASGLifecycle,
+		RespectProtection:   *cliRespectProtection,
+		TerminateStopped:    *cliTerminateStopped,
+		SkipTransitional:    *cliSkipTransitional,
+		DescribeStatus:      *cliDescribeStatus,
+		RequireEmpty:        *cliRequireEmpty,
+		Confirmations:       *cliConfirmations,
+		AnnotateThenWait:    *cliAnnotateThenWait,
+		PendingDeleteWait:   *cliPendingDeleteWait,
+		MaxDeletions:        *cliMaxDeletions,
+		DeleteRate:          *cliDeleteRate,
+		MaxDeletionFraction: *cliMaxDeletionFraction,
+		MinExpectedNodes:    *cliMinExpectedNodes,
+		Concurrency:         *cliConcurrency,
+		RequestTimeout:      *cliRequestTimeout,
+		MaxDeleteFailures:   *cliMaxDeleteFailures,
+		DeleteRetries:       *cliDeleteRetries,
+		DeleteCooldown:      *cliDeleteCooldown,
+		PreDeleteExec:       *cliPreDeleteExec,
+		PreDeleteTimeout:    *cliPreDeleteTimeout,
+		CordonOnly:          *cliCordonOnly,
+		Drain:               *cliDrain,
+		DrainTimeout:        *cliDrainTimeout,
+		DrainForce:          *cliDrainForce,
+		DeletePropagation:   metav1.DeletionPropagation(*cliDeletePropagation),
+		DryRun:              *cliDryRun,
+		Quiet:               *cliQuiet,
+		SummarizeDeletions:  *cliSummarizeDeletions,
+		ReportFile:          *cliReportFile,
+		ClusterName:         *cliClusterName,
+	}
+
+	// A single pass doesn't care how often passes would run.
+	if !*cliOnce {
+		err = checkFrequency(opts.Frequency, *cliMinFrequencyOK)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Nor does it remember how long instances have been missing for, so the
+	// grace would never run out.
+	if *cliOnce && opts.NotFoundGrace > 0 {
+		return fmt.Errorf("--instance-not-found-grace can't be used with --once")
+	}
+
+	// Checked up front, before any clients are built, rather than waiting
+	// for cleanup.New to turn them down.
+	err = cleanup.ValidateOptions(opts)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	var (
-		svc     = ec2.New(session.New(&aws.Config{Region: aws.String(region)}))
-		limiter = time.Tick(*cliFrequency)
-	)
+	// Negative grace periods leave it up to the API server.
+	if *cliDeleteGracePeriod >= 0 {
+		opts.DeleteGracePeriod = cliDeleteGracePeriod
+	}
 
-	config, err := rest.InClusterConfig()
+	opts.RequireConditions, err = cleanup.ParseConditions(*cliRequireConditions)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	opts.ProtectTaints, err = cleanup.ParseTaints(*cliProtectTaints)
+	if err != nil {
+		return err
+	}
+
+	opts.DeletableStates, err = parseStates(*cliDeletableStates)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("invalid deletable states: %v", err)
 	}
 
-	for {
-		<-limiter
+	opts.NodeNameFilter, err = regexp.Compile(*cliNodeNameFilter)
+	if err != nil {
+		return fmt.Errorf("invalid node name filter: %v", err)
+	}
 
-		list, err := clientset.CoreV1().Nodes().List(metav1.ListOptions{})
+	if *cliRequireTag != "" {
+		opts.RequireTagKey, opts.RequireTagValue, err = parseTag(*cliRequireTag)
 		if err != nil {
-			log.Println("Failed to lookup node list:", err)
-			continue
+			return fmt.Errorf("invalid required tag: %v", err)
+		}
+	}
+
+	if *cliInstanceTagFilter != "" {
+		// Every instance we know about carries the tag, so requiring it too
+		// would only ever keep the nodes whose instances we couldn't find.
+		if *cliRequireTag != "" {
+			return fmt.Errorf("--instance-tag-filter and --require-tag can't be used together")
+		}
+
+		opts.InstanceTagKey, opts.InstanceTagValue, err = parseTag(*cliInstanceTagFilter)
+		if err != nil {
+			return fmt.Errorf("invalid instance tag filter: %v", err)
+		}
+	}
+
+	regions := parseRegions(*cliRegions)
+
+	// Without instances to look up, there is no need for any AWS clients.
+	if opts.SkipInstanceCheck {
+		err = checkSkipInstanceCheck(opts)
+		if err != nil {
+			return err
 		}
 
-		for _, node := range list.Items {
-			// If this instance is ready, we don't want to clean it up.
-			ready, err := isReady(node.Status.Conditions)
-			if err != nil {
-				log.Println("Failed to check if instance is ready:", err)
-				continue
-			}
+		if opts.ClusterName != "" {
+			slog.Warn("Instances are not checked for the cluster tag with --skip-instance-check", "cluster", opts.ClusterName)
+		}
 
-			if ready {
-				log.Println("Node is ready, skipping:", node.ObjectMeta.Name)
-				continue
-			}
+		regions = nil
+	} else if len(regions) == 0 {
+		region, err := awsRegion(*cliRegion, *cliEC2Endpoint, newIMDSClient(*cliIMDSVersion).Region)
+		if err != nil {
+			return fmt.Errorf("failed to determine aws region: %v", err)
+		}
 
-			// We don't want to clean up any running instances.
-			running, err := isRunning(svc, node.Spec.ExternalID)
-			if err != nil {
-				log.Println("Failed to check if instance is running:", err)
-				continue
-			}
+		regions = []string{region}
+	}
 
-			if running {
-				log.Println("Node is running, skipping:", node.ObjectMeta.Name)
-				continue
-			}
+	clients := make(map[string]cleanup.RegionClient)
 
-			if *cliDryRun {
-				log.Println("Node would have been deleted, skipping:", node.ObjectMeta.Name)
-				continue
-			}
+	// A typo in a mounted file or profile name is easier to spot now than as
+	// a failure to describe instances later on.
+	var creds *credentials.Credentials
 
-			err = clientset.CoreV1().Nodes().Delete(node.ObjectMeta.Name, &metav1.DeleteOptions{})
-			if err != nil {
-				log.Println("Failed to delete node:", err)
-			}
+	if len(regions) > 0 {
+		creds, err = awsCredentials(*cliAWSCredentialsFile, *cliAWSProfile)
+		if err != nil {
+			return err
 		}
 	}
-}
 
-// Helper function to check if a Kubernetes node is "Ready".
-func isReady(conditions []v1.NodeCondition) (bool, error) {
-	for _, condition := range conditions {
-		if condition.Type != v1.NodeReady {
-			continue
+	for _, region := range regions {
+		partition, err := regionPartition(region, *cliPartition)
+		if err != nil {
+			return err
+		}
+
+		// STS credentials for an assumed role come from the same partition.
+		sess := session.New(&aws.Config{Region: aws.String(region), EndpointResolver: partition, Credentials: creds})
+
+		// Calls are retried by our own wrapper, the SDK retrying underneath it
+		// as well would multiply the attempts.
+		svc := ec2.New(sess, ec2Config(sess, *cliEC2Endpoint, *cliAssumeRoleARN, *cliAssumeRoleExternalID, 0))
+		svc.Handlers.Complete.PushBack(observeEC2Request)
+
+		client := cleanup.RegionClient{
+			EC2: cleanup.NewRetryingEC2(svc, *cliMaxRetries),
 		}
 
-		if condition.Status == v1.ConditionFalse {
-			return true, nil
+		if *cliCheckASGLifecycle || *cliRespectProtection {
+			client.ASG = autoscaling.New(sess, ec2Config(sess, "", *cliAssumeRoleARN, *cliAssumeRoleExternalID, *cliMaxRetries))
 		}
 
-		return false, nil
+		clients[region] = client
+	}
+
+	config, err := kubeConfig(*cliKubeconfig)
+	if err != nil {
+		return fmt.Errorf("failed to load kubernetes config: %v", err)
+	}
+
+	// Bound every Kubernetes API call so a hung apiserver can't wedge the loop.
+	config.Timeout = *cliRequestTimeout
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to build kubernetes client: %v", err)
+	}
+
+	err = cleanup.SelfTestKubernetes(clientset)
+	if err != nil {
+		return fmt.Errorf("startup self test failed, check RBAC permissions: %v", err)
+	}
+
+	for region, client := range clients {
+		err = cleanup.SelfTestEC2(client.EC2, *cliRequestTimeout)
+		if err != nil {
+			return fmt.Errorf("startup self test failed in %s, check IAM permissions: %v", region, err)
+		}
 	}
 
-	return false, fmt.Errorf("cannot find condition type: %s", v1.NodeReady)
+	// Record events against the nodes we delete so there is an audit trail in
+	// the cluster, making sure they are written before we exit.
+	recorder, events := newEventRecorder(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")}, cleanup.Component)
+	defer events.Flush(eventFlushTimeout)
+
+	serverConfig, err := serverTLS(*cliTLSCert, *cliTLSKey)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	err = serveMetrics(*cliMetricsAddr, serverConfig, *cliMetricsAuthToken)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics server: %v", err)
+	}
+
+	// Perform a single pass and exit, eg. when running as a CronJob. There
+	// are no previous passes to confirm against, so don't wait for any.
+	if *cliOnce {
+		opts.Confirmations = 1
+	}
+
+	instance, _ := os.Hostname()
+
+	opts.Notifications = cleanup.Notifications{
+		SlackWebhook:    *cliSlackWebhook,
+		WebhookURL:      *cliWebhookURL,
+		WebhookSecret:   *cliWebhookSecret,
+		WebhookTimeout:  *cliWebhookTimeout,
+		ClusterName:     *cliClusterName,
+		AuditLog:        *cliAuditLog,
+		AuditLogMaxSize: int64(*cliAuditLogMaxSize),
+		PushgatewayURL:  *cliPushgatewayURL,
+		Instance:        instance,
+		OtelEndpoint:    *cliOtelEndpoint,
+	}
+
+	reconciler, err := cleanup.New(clients, clientset, recorder, opts)
+	if err != nil {
+		return err
+	}
+	defer reconciler.Close()
+
+	// Only let callers who know the token trigger passes.
+	var trigger http.Handler
+
+	if *cliTriggerToken != "" {
+		trigger = &triggerHandler{token: *cliTriggerToken, reconciler: reconciler}
+	}
+
+	err = serveHealth(*cliHealthAddr, serverConfig, reconciler, trigger)
+	if err != nil {
+		return fmt.Errorf("failed to start health server: %v", err)
+	}
+
+	// Profiling is off by default, it exposes a lot about the process.
+	if *cliPprofAddr != "" {
+		err = servePprof(*cliPprofAddr)
+		if err != nil {
+			return fmt.Errorf("failed to start pprof server: %v", err)
+		}
+	}
+
+	// Cancel the context on SIGTERM/SIGINT so we can finish the node we are
+	// currently processing and exit cleanly.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	if *cliOnce {
+		return reconciler.ReconcileOnce(ctx)
+	}
+
+	if !*cliLeaderElect {
+		return reconciler.Run(ctx)
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to determine leader election identity: %v", err)
+	}
+
+	// Standbys are healthy while they wait to become the leader.
+	reconciler.Standby()
+
+	elector := &leaderElector{
+		clientset: clientset,
+		namespace: *cliLeaderElectNamespace,
+		name:      *cliLeaderElectName,
+		identity:  identity,
+	}
+
+	return elector.Run(ctx, reconciler.Run)
 }
 
-// Helper function to check if an AWS node is "Running".
-func isRunning(svc *ec2.EC2, id string) (bool, error) {
-	resp, err := svc.DescribeInstances(&ec2.DescribeInstancesInput{
-		InstanceIds: []*string{
-			aws.String(id),
-		},
-	})
+// Helper function to make sure nodes can't be deleted just for being briefly
+// not ready when their instances aren't being checked, and that nothing
+// which depends on the instances has been asked for.
+func checkSkipInstanceCheck(opts cleanup.Options) error {
+	if opts.NotReadyGrace <= 0 {
+		return fmt.Errorf("--skip-instance-check requires --notready-grace")
+	}
+
+	switch {
+	case opts.RequireTagKey != "":
+		return fmt.Errorf("--skip-instance-check and --require-tag can't be used together")
+	case opts.InstanceTagKey != "":
+		return fmt.Errorf("--skip-instance-check and --instance-tag-filter can't be used together")
+	case opts.TerminateStopped:
+		return fmt.Errorf("--skip-instance-check and --terminate-stopped can't be used together")
+	case opts.CheckASGLifecycle:
+		return fmt.Errorf("--skip-instance-check and --check-asg-lifecycle can't be used together")
+	case opts.RespectProtection:
+		return fmt.Errorf("--skip-instance-check and --respect-termination-protection can't be used together")
+	case opts.NotFoundGrace > 0:
+		return fmt.Errorf("--skip-instance-check and --instance-not-found-grace can't be used together")
+	}
+
+	return nil
+}
+
+// Helper function to refuse frequencies so short they would hammer the
+// Kubernetes and AWS APIs, unless the override is set.
+func checkFrequency(frequency time.Duration, override bool) error {
+	if frequency <= 0 {
+		return fmt.Errorf("frequency must be greater than 0: %s", frequency)
+	}
+
+	if frequency < minFrequency && !override {
+		return fmt.Errorf("frequency must be at least %s, set --min-frequency-override to allow shorter: %s", minFrequency, frequency)
+	}
+
+	return nil
+}
+
+// Helper function to determine which AWS region to query, preferring an
+// explicitly configured region over the EC2 metadata service. There is no
+// metadata service to ask when talking to a custom endpoint, so a default
+// region is used instead.
+func awsRegion(region, endpoint string, metadata func() (string, error)) (string, error) {
+	if region = strings.TrimSpace(region); region != "" {
+		return region, nil
+	}
+
+	if endpoint != "" {
+		return defaultEndpointRegion, nil
+	}
+
+	region, err := metadata()
 	if err != nil {
-		return false, err
+		return "", err
+	}
+
+	// Some restricted environments answer without saying which region we
+	// are in, and every AWS call would fail without one.
+	if strings.TrimSpace(region) == "" {
+		return "", errors.New("EC2 metadata returned an empty region, set --region instead")
+	}
+
+	return region, nil
+}
+
+// Helper function to load static credentials from a shared credentials file,
+// when a file or profile is set. Otherwise nil is returned, leaving the session
+// to the default credential chain. The SDK's defaults fill in whichever of the
+// file and profile isn't set.
+func awsCredentials(file, profile string) (*credentials.Credentials, error) {
+	if file == "" && profile == "" {
+		return nil, nil
 	}
 
-	// If we have no reservations, then we can assume that the instance is terminated.
-	if len(resp.Reservations) == 0 {
-		return false, nil
+	creds := credentials.NewSharedCredentials(file, profile)
+
+	_, err := creds.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws credentials: %v", err)
 	}
 
-	for _, reservation := range resp.Reservations {
-		for _, instance := range reservation.Instances {
-			if *instance.InstanceId != id {
-				continue
-			}
+	return creds, nil
+}
 
-			// We have found our running instance.
-			if *instance.State.Name == ec2.InstanceStateNameRunning {
-				return true, nil
-			}
+// Helper function to build the EC2 client config, pointing it at a custom
+// endpoint (such as LocalStack) and assuming the given IAM role when they are
+// set, so instances in another account can be described. The SDK retries
+// failed calls up to maxRetries times.
+func ec2Config(sess client.ConfigProvider, endpoint, roleARN, externalID string, maxRetries int) *aws.Config {
+	config := &aws.Config{MaxRetries: aws.Int(maxRetries)}
 
-			return false, nil
+	if endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+
+	if roleARN == "" {
+		return config
+	}
+
+	return config.WithCredentials(stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
 		}
+	}))
+}
+
+// Helper function to build the Kubernetes client config, from a kubeconfig file
+// if one was provided, otherwise from the in-cluster service account.
+func kubeConfig(path string) (*rest.Config, error) {
+	if path == "" {
+		return rest.InClusterConfig()
+	}
+
+	return clientcmd.BuildConfigFromFlags("", path)
+}
+
+// Helper function to parse and validate a comma separated list of instance states.
+func parseStates(list string) ([]string, error) {
+	var states []string
+
+	for _, state := range strings.Split(list, ",") {
+		state = strings.TrimSpace(state)
+		if state == "" {
+			continue
+		}
+
+		switch state {
+		case ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning, ec2.InstanceStateNameShuttingDown,
+			ec2.InstanceStateNameTerminated, ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped:
+			states = append(states, state)
+		default:
+			return nil, fmt.Errorf("unknown instance state: %s", state)
+		}
+	}
+
+	return states, nil
+}
+
+// Helper function to split a key=value tag.
+func parseTag(tag string) (string, string, error) {
+	key, value, ok := strings.Cut(tag, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("expected key=value, got %q", tag)
 	}
 
-	return false, fmt.Errorf("cannot find running instance: %s", id)
+	return key, value, nil
 }
@@ -1,9 +1,160 @@
 package main
 
-func TestIsReady() {
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/previousnext/k8s-aws-node-cleanup/cleanup"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCheckSkipInstanceCheck(t *testing.T) {
+	assert.NotNil(t, checkSkipInstanceCheck(cleanup.Options{}))
+	assert.Nil(t, checkSkipInstanceCheck(cleanup.Options{NotReadyGrace: time.Hour}))
+	assert.NotNil(t, checkSkipInstanceCheck(cleanup.Options{NotReadyGrace: time.Hour, RequireTagKey: "cluster"}))
+	assert.NotNil(t, checkSkipInstanceCheck(cleanup.Options{NotReadyGrace: time.Hour, TerminateStopped: true}))
+	assert.NotNil(t, checkSkipInstanceCheck(cleanup.Options{NotReadyGrace: time.Hour, RespectProtection: true}))
+	assert.NotNil(t, checkSkipInstanceCheck(cleanup.Options{NotReadyGrace: time.Hour, NotFoundGrace: time.Minute}))
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, exitFatal, exitCode(errors.New("listed 0 nodes, fewer than the minimum expected of 3")))
+	assert.Equal(t, exitFatal, exitCode(errors.New("failed to lookup node list")))
+
+	// A pass which couldn't inspect every node is only a partial failure.
+	unparseable := testNode("not-ready-unparseable", "", v1.ConditionFalse)
+	unparseable.Spec.ProviderID = "aws:///ap-southeast-2a/"
+
+	clients := map[string]cleanup.RegionClient{
+		"ap-southeast-2": {EC2: &stubEC2{}},
+	}
+
+	opts := cleanup.Options{
+		Frequency:       time.Hour,
+		DeletableStates: []string{ec2.InstanceStateNameTerminated},
+		Confirmations:   1,
+		Concurrency:     5,
+		RequestTimeout:  30 * time.Second,
+	}
+
+	r, err := cleanup.New(clients, fake.NewSimpleClientset(unparseable), record.NewFakeRecorder(100), opts)
+	assert.Nil(t, err)
+
+	err = r.ReconcileOnce(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, exitPartial, exitCode(err))
+}
+
+func TestCheckFrequency(t *testing.T) {
+	assert.Nil(t, checkFrequency(2*time.Minute, false))
+	assert.Nil(t, checkFrequency(minFrequency, false))
+	assert.NotNil(t, checkFrequency(time.Millisecond, false))
+	assert.Nil(t, checkFrequency(time.Millisecond, true))
+
+	// Overriding the minimum doesn't allow a loop without any delay.
+	assert.NotNil(t, checkFrequency(0, true))
+	assert.NotNil(t, checkFrequency(-time.Second, true))
+}
+
+func TestParseStates(t *testing.T) {
+	states, err := parseStates("terminated, shutting-down")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ec2.InstanceStateNameTerminated, ec2.InstanceStateNameShuttingDown}, states)
+
+	_, err = parseStates("terminated,gone")
+	assert.NotNil(t, err)
 }
 
-func TestIsRunning() {
+func TestAWSCredentials(t *testing.T) {
+	creds, err := awsCredentials("", "")
+	assert.Nil(t, err)
+	assert.Nil(t, creds)
+
+	path := filepath.Join(t.TempDir(), "credentials")
+
+	err = os.WriteFile(path, []byte("[node-cleanup]\naws_access_key_id = AKIDEXAMPLE\naws_secret_access_key = secret\n"), 0600)
+	assert.Nil(t, err)
+
+	creds, err = awsCredentials(path, "node-cleanup")
+	assert.Nil(t, err)
+
+	value, err := creds.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKIDEXAMPLE", value.AccessKeyID)
+
+	// Credentials which can't be resolved are caught up front.
+	_, err = awsCredentials(path, "missing")
+	assert.NotNil(t, err)
+
+	_, err = awsCredentials(filepath.Join(t.TempDir(), "missing"), "node-cleanup")
+	assert.NotNil(t, err)
+}
+
+func TestEC2Config(t *testing.T) {
+	sess := session.New(&aws.Config{Region: aws.String("ap-southeast-2")})
+
+	assert.Nil(t, ec2Config(sess, "", "", "", 0).Credentials)
+	assert.Nil(t, ec2Config(sess, "", "", "", 0).Endpoint)
+	assert.NotNil(t, ec2Config(sess, "", "arn:aws:iam::123456789012:role/node-cleanup", "abc", 0).Credentials)
+	assert.Equal(t, "http://localhost:4566", aws.StringValue(ec2Config(sess, "http://localhost:4566", "", "", 0).Endpoint))
+
+	// The SDK's own retries are only left on when asked for.
+	assert.Equal(t, 0, aws.IntValue(ec2Config(sess, "", "", "", 0).MaxRetries))
+	assert.Equal(t, 5, aws.IntValue(ec2Config(sess, "", "", "", 5).MaxRetries))
+}
+
+func TestAWSRegion(t *testing.T) {
+	metadata := func(region string, err error) func() (string, error) {
+		return func() (string, error) {
+			return region, err
+		}
+	}
+
+	region, err := awsRegion("ap-southeast-2", "http://localhost:4566", metadata("", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "ap-southeast-2", region)
+
+	region, err = awsRegion("", "http://localhost:4566", metadata("", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultEndpointRegion, region)
+
+	region, err = awsRegion("", "", metadata("us-west-2", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "us-west-2", region)
+
+	_, err = awsRegion("", "", metadata("", fmt.Errorf("connection refused")))
+	assert.NotNil(t, err)
+
+	// An empty answer from the metadata service must not be used as a region.
+	_, err = awsRegion(" ", "", metadata("", nil))
+	assert.NotNil(t, err)
+}
+
+func TestParseTag(t *testing.T) {
+	key, value, err := parseTag("KubernetesCluster=prod")
+	assert.Nil(t, err)
+	assert.Equal(t, "KubernetesCluster", key)
+	assert.Equal(t, "prod", value)
+
+	key, value, err = parseTag("owned=")
+	assert.Nil(t, err)
+	assert.Equal(t, "owned", key)
+	assert.Equal(t, "", value)
+
+	_, _, err = parseTag("KubernetesCluster")
+	assert.NotNil(t, err)
 
+	_, _, err = parseTag("=prod")
+	assert.NotNil(t, err)
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/tools/metrics"
+)
+
+var (
+	metricEC2RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ec2_request_duration_seconds",
+		Help: "How long calls to the EC2 API took, by operation.",
+	}, []string{"operation"})
+	metricK8sRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "k8s_request_duration_seconds",
+		Help: "How long calls to the Kubernetes API took, by verb.",
+	}, []string{"verb"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricEC2RequestDuration,
+		metricK8sRequestDuration,
+	)
+
+	metrics.Register(k8sRequestMetrics{}, k8sRequestMetrics{})
+}
+
+// Helper function to record how long an EC2 call took, including any retries
+// the SDK made. It is added to the Complete handlers of the EC2 client.
+func observeEC2Request(r *request.Request) {
+	duration := time.Since(r.Time)
+
+	metricEC2RequestDuration.WithLabelValues(r.Operation.Name).Observe(duration.Seconds())
+
+	slog.Debug("EC2 request finished", "operation", r.Operation.Name, "duration", duration, "error", r.Error)
+}
+
+// Records how long Kubernetes calls took, as reported by client-go.
+type k8sRequestMetrics struct{}
+
+func (k8sRequestMetrics) Observe(verb string, u url.URL, latency time.Duration) {
+	metricK8sRequestDuration.WithLabelValues(verb).Observe(latency.Seconds())
+
+	slog.Debug("Kubernetes request finished", "verb", verb, "path", u.Path, "duration", latency)
+}
+
+// Response codes are already covered by the errors we log and count.
+func (k8sRequestMetrics) Increment(code, method, host string) {}
+
+// Helper function to serve Prometheus metrics on the given address, only to
+// scrapers with the bearer token when one is set. The listener is opened up
+// front so a bad address fails at startup.
+func serveMetrics(addr string, config *tls.Config, token string) error {
+	listener, err := listen(addr, config)
+	if err != nil {
+		return err
+	}
+
+	handler := promhttp.Handler()
+
+	if token != "" {
+		handler = requireToken(token, handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+
+	go http.Serve(listener, mux)
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/metrics"
+)
+
+// Helper function to count the observations made by a histogram.
+func observations(t *testing.T, histogram prometheus.Histogram) uint64 {
+	var m dto.Metric
+
+	err := histogram.Write(&m)
+	assert.Nil(t, err)
+
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestObserveEC2Request(t *testing.T) {
+	histogram := metricEC2RequestDuration.WithLabelValues("DescribeInstances")
+	before := observations(t, histogram)
+
+	observeEC2Request(&request.Request{
+		Operation: &request.Operation{Name: "DescribeInstances"},
+		Time:      time.Now().Add(-time.Second),
+	})
+
+	assert.Equal(t, before+1, observations(t, histogram))
+}
+
+func TestK8sRequestMetrics(t *testing.T) {
+	histogram := metricK8sRequestDuration.WithLabelValues("DELETE")
+	before := observations(t, histogram)
+
+	// client-go reports through whatever was registered.
+	metrics.RequestLatency.Observe("DELETE", url.URL{Path: "/api/v1/nodes/node1"}, time.Second)
+
+	assert.Equal(t, before+1, observations(t, histogram))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+)
+
+// Helper function to find the AWS partition (eg. aws, aws-cn or aws-us-gov) a
+// region belongs to, so EC2 and STS endpoints are resolved within it. When a
+// partition is given the region must belong to it, otherwise it is worked out
+// from the region name.
+func regionPartition(region, id string) (endpoints.Partition, error) {
+	partitions := endpoints.DefaultPartitions()
+
+	if id == "" {
+		partition, ok := endpoints.PartitionForRegion(partitions, region)
+		if !ok {
+			return endpoints.Partition{}, fmt.Errorf("cannot determine partition for region: %s", region)
+		}
+
+		return partition, nil
+	}
+
+	for _, partition := range partitions {
+		if partition.ID() != id {
+			continue
+		}
+
+		if _, ok := endpoints.PartitionForRegion([]endpoints.Partition{partition}, region); !ok {
+			return endpoints.Partition{}, fmt.Errorf("region %s is not in partition: %s", region, id)
+		}
+
+		return partition, nil
+	}
+
+	return endpoints.Partition{}, fmt.Errorf("unknown partition: %s", id)
+}
+
+// Helper function to parse a comma separated list of regions.
+func parseRegions(list string) []string {
+	var regions []string
+
+	for _, region := range strings.Split(list, ",") {
+		region = strings.TrimSpace(region)
+		if region != "" {
+			regions = append(regions, region)
+		}
+	}
+
+	return regions
+}
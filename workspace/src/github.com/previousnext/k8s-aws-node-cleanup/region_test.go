@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegions(t *testing.T) {
+	assert.Equal(t, []string{"ap-southeast-2", "us-east-1"}, parseRegions(" ap-southeast-2, us-east-1,,"))
+	assert.Nil(t, parseRegions(""))
+}
+
+func TestRegionPartition(t *testing.T) {
+	tests := []struct {
+		region    string
+		id        string
+		partition string
+		ec2       string
+		sts       string
+		err       bool
+	}{
+		{region: "ap-southeast-2", partition: "aws", ec2: "https://ec2.ap-southeast-2.amazonaws.com", sts: "https://sts.amazonaws.com"},
+		{region: "us-gov-west-1", partition: "aws-us-gov", ec2: "https://ec2.us-gov-west-1.amazonaws.com", sts: "https://sts.us-gov-west-1.amazonaws.com"},
+		{region: "us-gov-east-1", partition: "aws-us-gov", ec2: "https://ec2.us-gov-east-1.amazonaws.com", sts: "https://sts.us-gov-east-1.amazonaws.com"},
+		{region: "cn-north-1", partition: "aws-cn", ec2: "https://ec2.cn-north-1.amazonaws.com.cn", sts: "https://sts.cn-north-1.amazonaws.com.cn"},
+		{region: "cn-northwest-1", partition: "aws-cn", ec2: "https://ec2.cn-northwest-1.amazonaws.com.cn", sts: "https://sts.cn-northwest-1.amazonaws.com.cn"},
+		{region: "cn-north-1", id: "aws-cn", partition: "aws-cn", ec2: "https://ec2.cn-north-1.amazonaws.com.cn", sts: "https://sts.cn-north-1.amazonaws.com.cn"},
+		{region: "us-gov-west-1", id: "aws-us-gov", partition: "aws-us-gov", ec2: "https://ec2.us-gov-west-1.amazonaws.com", sts: "https://sts.us-gov-west-1.amazonaws.com"},
+		{region: "us-east-1", id: "aws-cn", err: true},
+		{region: "us-east-1", id: "aws-mars", err: true},
+		{region: "mars-east-1", err: true},
+	}
+
+	for _, test := range tests {
+		partition, err := regionPartition(test.region, test.id)
+		if test.err {
+			assert.NotNil(t, err, test.region)
+			continue
+		}
+
+		assert.Nil(t, err, test.region)
+		assert.Equal(t, test.partition, partition.ID(), test.region)
+
+		// The clients built from the session must resolve within the partition.
+		sess := session.New(&aws.Config{Region: aws.String(test.region), EndpointResolver: partition})
+		assert.Equal(t, test.ec2, ec2.New(sess).Endpoint, test.region)
+		assert.Equal(t, test.sts, sts.New(sess).Endpoint, test.region)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/previousnext/k8s-aws-node-cleanup/cleanup"
+)
+
+// Helper function to load the certificate and key to serve HTTPS with. Plain
+// HTTP is served when neither is given.
+func serverTLS(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a TLS certificate and key are required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Helper function to listen on the given address, over TLS when config is set.
+func listen(addr string, config *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return listener, nil
+	}
+
+	return tls.NewListener(listener, config), nil
+}
+
+// Helper function to check if a request carries the given bearer token.
+func hasBearerToken(r *http.Request, token string) bool {
+	actual, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(actual), []byte(token)) == 1
+}
+
+// Helper function to only pass requests carrying the given bearer token on to
+// a handler.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasBearerToken(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Helper function to serve the health and status endpoints, and /reconcile
+// when trigger is set, on the given address. The listener is opened up front
+// so a bad address fails at startup. Probes can't authenticate, so none of
+// these endpoints ask them to.
+func serveHealth(addr string, config *tls.Config, reconciler *cleanup.Reconciler, trigger http.Handler) error {
+	listener, err := listen(addr, config)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", reconciler.Healthz)
+	mux.HandleFunc("/readyz", reconciler.Readyz)
+	mux.HandleFunc("/status", reconciler.Status)
+
+	if trigger != nil {
+		mux.Handle("/reconcile", trigger)
+	}
+
+	go http.Serve(listener, mux)
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/previousnext/k8s-aws-node-cleanup/cleanup"
+)
+
+// Serves POST /reconcile, running a pass out of band for callers presenting
+// the shared token as a bearer token.
+type triggerHandler struct {
+	token      string
+	reconciler *cleanup.Reconciler
+}
+
+func (t *triggerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !hasBearerToken(r, t.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	report, err := t.reconciler.Trigger(r.Context())
+	if err == cleanup.ErrNotRunning {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		// The caller has gone away, there is no one to tell.
+		return
+	}
+
+	status := http.StatusOK
+	if report.Error != "" {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
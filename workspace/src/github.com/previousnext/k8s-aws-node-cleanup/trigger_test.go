@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/previousnext/k8s-aws-node-cleanup/cleanup"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Answers DescribeInstances from a map of instance IDs to states. Nothing else
+// is needed for triggered passes.
+type stubEC2 struct {
+	cleanup.EC2API
+	states map[string]string
+}
+
+func (s *stubEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	var instances []*ec2.Instance
+
+	for _, id := range input.InstanceIds {
+		state, ok := s.states[aws.StringValue(id)]
+		if !ok {
+			continue
+		}
+
+		instances = append(instances, &ec2.Instance{
+			InstanceId: id,
+			State:      &ec2.InstanceState{Name: aws.String(state)},
+		})
+	}
+
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{Instances: instances}},
+	}, nil
+}
+
+// Helper function to build a node backed by an instance, with the given Ready status.
+func testNode(name, id string, ready v1.ConditionStatus) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{ExternalID: id},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+		},
+	}
+}
+
+// Helper function to POST to a trigger handler with the given token.
+func triggerPass(handler http.Handler, method, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/reconcile", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestTriggerHandler(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testNode("ready", "i-ready", v1.ConditionTrue),
+		testNode("not-ready-terminated", "i-terminated", v1.ConditionFalse),
+	)
+
+	clients := map[string]cleanup.RegionClient{
+		"ap-southeast-2": {
+			EC2: &stubEC2{
+				states: map[string]string{
+					"i-ready":      ec2.InstanceStateNameRunning,
+					"i-terminated": ec2.InstanceStateNameTerminated,
+					"i-replaced":   ec2.InstanceStateNameTerminated,
+				},
+			},
+		},
+	}
+
+	// Apart from the pass on start, scheduled passes are far enough away that
+	// only triggers run.
+	opts := cleanup.Options{
+		Frequency:       time.Hour,
+		DeletableStates: []string{ec2.InstanceStateNameTerminated},
+		Confirmations:   1,
+		Concurrency:     5,
+		RequestTimeout:  30 * time.Second,
+	}
+
+	r, err := cleanup.New(clients, clientset, record.NewFakeRecorder(100), opts)
+	assert.Nil(t, err)
+	handler := &triggerHandler{token: "secret", reconciler: r}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, triggerPass(handler, "GET", "secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, triggerPass(handler, "POST", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, triggerPass(handler, "POST", "wrong").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, triggerPass(handler, "POST", "secret").Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go r.Run(ctx)
+
+	// The pass on start gets to the terminated node before any trigger.
+	for {
+		_, err := clientset.CoreV1().Nodes().Get("not-ready-terminated", metav1.GetOptions{})
+		if err != nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = clientset.CoreV1().Nodes().Create(testNode("not-ready-replaced", "i-replaced", v1.ConditionFalse))
+	assert.Nil(t, err)
+
+	w := triggerPass(handler, "POST", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var report cleanup.PassReport
+
+	err = json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, report.Listed)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, []cleanup.CandidateReport{{Node: "not-ready-replaced", InstanceID: "i-replaced", State: ec2.InstanceStateNameTerminated}}, report.Candidates)
+
+	// Overlapping triggers never run passes at the same time.
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusOK, triggerPass(handler, "POST", "secret").Code)
+		}()
+	}
+
+	wg.Wait()
+}